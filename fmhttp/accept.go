@@ -0,0 +1,43 @@
+package fmhttp
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type acceptItem struct {
+	Value string
+	Q     float64
+}
+
+// parseAcceptHeader parses the headers like Accept-Language and Accept-Encoding: "da, en-gb;q=0.8, en;q=0.7".
+// The items are sorted by the quality from high to low, the items with q=0 are kept, they mean "not acceptable".
+func parseAcceptHeader(header string) (items []acceptItem) {
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		item := acceptItem{Value: value, Q: 1}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(k) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && q >= 0 && q <= 1 {
+					item.Q = q
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	slices.SortStableFunc(items, func(a, b acceptItem) int {
+		if a.Q > b.Q {
+			return -1
+		} else if a.Q < b.Q {
+			return 1
+		}
+		return 0
+	})
+	return items
+}
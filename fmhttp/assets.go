@@ -0,0 +1,203 @@
+package fmhttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	assetHashLength = 10
+	assetIndexFile  = "index.html"
+
+	assetCacheControlImmutable  = "public, max-age=31536000, immutable"
+	assetCacheControlRevalidate = "no-cache"
+)
+
+// the precompressed siblings of the assets, in the preferred order: "app.css.br", "app.css.gz"
+var assetPrecompressedExts = []struct {
+	ext      string
+	encoding string
+}{
+	{ext: ".br", encoding: EncodingBrotli},
+	{ext: ".gz", encoding: EncodingGzip},
+}
+
+// AssetPipeline fingerprints the assets by their content hashes: "css/app.css" is served as "css/app.3f9a1c2b4d.css" too.
+// The fingerprinted paths are cached forever by the browsers, the other paths are revalidated by ETag and Last-Modified.
+type AssetPipeline struct {
+	fsys fs.FS
+
+	// the content hashes of the assets, and the assets of the fingerprinted names
+	hashes      map[string]string
+	hashedNames map[string]string
+}
+
+// NewAssetPipeline computes the content hashes of all files if fingerprint is true (it is false in DevMode, the files may change)
+func NewAssetPipeline(fsys fs.FS, fingerprint bool) (*AssetPipeline, error) {
+	p := &AssetPipeline{fsys: fsys, hashes: map[string]string{}, hashedNames: map[string]string{}}
+	if !fingerprint {
+		return p, nil
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || assetPrecompressedEncoding(name) != "" {
+			return nil
+		}
+		hash, err := assetContentHash(fsys, name)
+		if err != nil {
+			return err
+		}
+		p.hashes[name] = hash
+		p.hashedNames[assetHashedName(name, hash)] = name
+		return nil
+	})
+	return p, err
+}
+
+func assetPrecompressedEncoding(name string) string {
+	for _, pc := range assetPrecompressedExts {
+		if strings.HasSuffix(name, pc.ext) {
+			return pc.encoding
+		}
+	}
+	return ""
+}
+
+func assetContentHash(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:assetHashLength], nil
+}
+
+// assetHashedName inserts the hash before the extension: "css/app.css" => "css/app.3f9a1c2b4d.css"
+func assetHashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// HashedName returns the fingerprinted name of an asset, or the name itself if the asset is not fingerprinted
+func (p *AssetPipeline) HashedName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hash, ok := p.hashes[name]; ok {
+		return assetHashedName(name, hash)
+	}
+	return name
+}
+
+// resolve returns the asset name of a requested name, hashed is true if the requested name is fingerprinted
+func (p *AssetPipeline) resolve(reqName string) (name string, hashed bool) {
+	if name, ok := p.hashedNames[reqName]; ok {
+		return name, true
+	}
+	return reqName, false
+}
+
+// openPrecompressed opens the precompressed sibling of the asset if it is accepted by the client
+func (p *AssetPipeline) openPrecompressed(name, acceptEncoding string) (fs.File, string) {
+	if acceptEncoding == "" {
+		return nil, ""
+	}
+	opt := CompressOptions{}
+	for _, pc := range assetPrecompressedExts {
+		opt.Encodings = []string{pc.encoding}
+		if opt.negotiateEncoding(acceptEncoding) == "" {
+			continue
+		}
+		if f, err := p.fsys.Open(name + pc.ext); err == nil {
+			return f, pc.encoding
+		}
+	}
+	return nil, ""
+}
+
+// assetStat returns the asset file of the name, the "index.html" is used for a directory
+func (p *AssetPipeline) assetStat(name string) (string, fs.FileInfo, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", nil, fs.ErrNotExist
+	}
+	st, err := fs.Stat(p.fsys, name)
+	if err == nil && st.IsDir() {
+		name = path.Join(name, assetIndexFile)
+		st, err = fs.Stat(p.fsys, name)
+	}
+	if err == nil && st.IsDir() {
+		err = fs.ErrNotExist
+	}
+	return name, st, err
+}
+
+// respondAsset serves an asset file or the index file of a directory, the directories are not listed
+func (hs *HttpServer) respondAsset(c *Context, reqName string) Response {
+	p := hs.assets
+	name, hashed := p.resolve(strings.TrimPrefix(reqName, "/"))
+	name, _, err := p.assetStat(name)
+	if err != nil {
+		return c.Respond(NewHttpError(http.StatusNotFound, "no static file: "+c.Request.URL.Path))
+	}
+
+	f, encoding := p.openPrecompressed(name, c.Request.Header.Get("Accept-Encoding"))
+	if f == nil {
+		if f, err = p.fsys.Open(name); err != nil {
+			return c.Respond(err)
+		}
+	}
+
+	// the name is used by http.ServeContent to detect the Content-Type by the extension
+	resp := c.RespondFile(name, f)
+	h := resp.Header()
+	if hashed {
+		h.Set("Cache-Control", assetCacheControlImmutable)
+	} else {
+		h.Set("Cache-Control", assetCacheControlRevalidate)
+	}
+	if hash := p.hashes[name]; hash != "" {
+		// the precompressed file is a different representation, it has a different ETag
+		etag := hash
+		if encoding != "" {
+			etag += "-" + encoding
+		}
+		h.Set("ETag", `"`+etag+`"`)
+	}
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	if p.hasPrecompressed(name) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	return resp
+}
+
+func (p *AssetPipeline) hasPrecompressed(name string) bool {
+	for _, pc := range assetPrecompressedExts {
+		if _, err := fs.Stat(p.fsys, name+pc.ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (hs *HttpServer) Assets() *AssetPipeline {
+	return hs.assets
+}
@@ -0,0 +1,78 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAssetPipeline(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	hs := testHttpServer(&Options{AssetsFS: fstest.MapFS{
+		"assets/web/assets/css/app.css":    {Data: []byte(`body{}`), ModTime: modTime},
+		"assets/web/assets/css/app.css.br": {Data: []byte(`br-data`), ModTime: modTime},
+		"assets/web/assets/js/app.js":      {Data: []byte(`alert(1)`), ModTime: modTime},
+		"assets/template/page.tmpl":        {Data: []byte(`{{asset "assets/css/app.css"}}|{{asset "/assets/js/app.js"}}|{{asset "assets/no-such.png"}}`)},
+	}})
+	// the common middlewares are not used by the assets
+	middlewareCalls := 0
+	hs.UseMiddleware(func(ce *ChainExecutor) Response {
+		middlewareCalls++
+		return ce.Next()
+	})
+	hs.HandleAssets("/assets/")
+	hs.HandleRequest("/page", func(c *Context) Response {
+		return c.RespondTmpl("page.tmpl", nil)
+	})
+
+	page := testServe(hs.serverMux, "GET", "/page").Body.String()
+	assert.Regexp(t, regexp.MustCompile(`^/assets/css/app\.[0-9a-f]{10}\.css\|/assets/js/app\.[0-9a-f]{10}\.js\|/assets/no-such\.png$`), page)
+	cssUrl := page[:len("/assets/css/app.0123456789.css")]
+
+	w := testServe(hs.serverMux, "GET", cssUrl)
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "body{}", w.Body.String())
+	assert.EqualValues(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.EqualValues(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	w = testServe(hs.serverMux, "GET", "/assets/css/app.css")
+	assert.EqualValues(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.EqualValues(t, etag, w.Header().Get("ETag"))
+	assert.EqualValues(t, modTime.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+	assert.EqualValues(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	assert.EqualValues(t, http.StatusNotModified, testServe(hs.serverMux, "GET", "/assets/css/app.css", "If-None-Match", etag).Code)
+	assert.EqualValues(t, http.StatusNotModified, testServe(hs.serverMux, "GET", "/assets/js/app.js", "If-Modified-Since", modTime.Format(http.TimeFormat)).Code)
+
+	w = testServe(hs.serverMux, "GET", cssUrl, "Accept-Encoding", "gzip, br")
+	assert.EqualValues(t, "br", w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "br-data", w.Body.String())
+	assert.NotEqualValues(t, etag, w.Header().Get("ETag"))
+
+	w = testServe(hs.serverMux, "GET", cssUrl, "Accept-Encoding", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "body{}", w.Body.String())
+
+	// no directory listing
+	assert.EqualValues(t, http.StatusNotFound, testServe(hs.serverMux, "GET", "/assets/").Code)
+	assert.EqualValues(t, http.StatusNotFound, testServe(hs.serverMux, "GET", "/assets/css").Code)
+	assert.EqualValues(t, http.StatusNotFound, testServe(hs.serverMux, "GET", "/assets/no-such.css").Code)
+	assert.EqualValues(t, 1, middlewareCalls)
+}
+
+func TestAssetsUrlPrefix(t *testing.T) {
+	hs := testHttpServer(&Options{AssetsUrlPrefix: "https://cdn.example.com/", AssetsFS: fstest.MapFS{
+		"assets/web/app.css":        {Data: []byte(`body{}`)},
+		"assets/template/page.tmpl": {Data: []byte(`{{asset "app.css"}}`)},
+	}})
+	sb := &strings.Builder{}
+	assert.NoError(t, hs.TmplRender(sb, "page.tmpl", nil))
+	assert.Regexp(t, `^https://cdn\.example\.com/app\.[0-9a-f]{10}\.css$`, sb.String())
+}
@@ -0,0 +1,391 @@
+package fmhttp
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// the struct tags of the request fields, eg: `path:"id"`, `query:"page"`, `header:"X-Request-Id"`, `form:"name"`.
+// The JSON body is decoded by the "json" tags.
+var bindTagSources = []string{"path", "query", "header", "form"}
+
+var typeTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Bind fills the struct pointed by v from the request: the body (JSON by "json" tags, or the form by "form" tags),
+// then the fields tagged by "path", "query" and "header". The errors are 400 *HttpError, or 413 if the body is larger
+// than the server's UploadMaxRequestSize.
+func (c *Context) Bind(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind: the target must be a pointer to struct, but: %T", v)
+	}
+
+	r := c.Request
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(headerContentType))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		r.Body = http.MaxBytesReader(c.ResponseWriter, r.Body, c.uploadOptions(nil).MaxRequestSize)
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return NewHttpError(http.StatusRequestEntityTooLarge, "request body too large").WithCode("body_too_large").Wrap(err)
+			}
+			return NewHttpError(http.StatusBadRequest, "invalid JSON body: "+err.Error()).WithCode("invalid_body").Wrap(err)
+		}
+	} else if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		if err := c.parseForm(); err != nil {
+			return err
+		}
+	}
+
+	return bindStruct(rv.Elem(), func(source, name string) ([]string, bool) {
+		switch source {
+		case "path":
+			for i := 0; i < len(c.pathParams); i += 2 {
+				if c.pathParams[i] == name {
+					return []string{c.pathParams[i+1]}, true
+				}
+			}
+		case "query":
+			if c.queryValues == nil {
+				c.queryValues = r.URL.Query()
+			}
+			values, ok := c.queryValues[name]
+			return values, ok
+		case "header":
+			values := r.Header.Values(name)
+			return values, len(values) != 0
+		case "form":
+			values, ok := r.PostForm[name]
+			return values, ok
+		}
+		return nil, false
+	})
+}
+
+func bindStruct(rv reflect.Value, lookup func(source, name string) ([]string, bool)) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		fv := rv.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if err := bindStruct(fv, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		for _, source := range bindTagSources {
+			name, _, _ := strings.Cut(sf.Tag.Get(source), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			values, ok := lookup(source, name)
+			if !ok {
+				continue
+			}
+			if err := setBindValue(fv, values); err != nil {
+				return NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid %s parameter %q: %v", source, name, err)).WithCode("invalid_param").Wrap(err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func setBindValue(fv reflect.Value, values []string) error {
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 && !fv.Addr().Type().Implements(typeTextUnmarshaler) {
+		slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, s := range values {
+			if err := setBindString(slice.Index(i), s); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return setBindString(fv, values[0])
+}
+
+func setBindString(fv reflect.Value, s string) error {
+	if fv.Kind() == reflect.Pointer {
+		ptr := reflect.New(fv.Type().Elem())
+		if err := setBindString(ptr.Elem(), s); err != nil {
+			return err
+		}
+		fv.Set(ptr)
+		return nil
+	}
+	if tu, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText([]byte(s))
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(v)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(v)
+	case reflect.Slice:
+		fv.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// ValidationErrors are the invalid fields and their messages, the fields are named by the tags (eg: json) of the struct
+type ValidationErrors map[string]string
+
+func (e ValidationErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + ": " + e[field]
+	}
+	return strings.Join(fields, "; ")
+}
+
+// Validator is implemented by the structs which need more checks than the "validate" tags,
+// it could return ValidationErrors to report the invalid fields
+type Validator interface {
+	Validate() error
+}
+
+// Validate checks the struct by the "validate" tags, eg: `validate:"required,min=1,max=100"`, then calls its Validator.
+// The rules are: required (not zero), min and max (the value of the numbers, the length of the strings, slices and maps),
+// oneof (eg: "oneof=asc desc") and email. The nested structs are validated too.
+// It returns a 422 *HttpError with the "errors" (ValidationErrors) extra. The rules of a struct type are checked when it is
+// validated first time, the invalid rules (eg: unknown rules, min/max for unsupported kinds) are returned as plain errors.
+func Validate(v any) error {
+	errs := ValidationErrors{}
+	if err := validateValue(reflect.ValueOf(v), "", errs); err != nil {
+		return err
+	}
+	if validator, ok := v.(Validator); ok && len(errs) == 0 {
+		if err := validator.Validate(); err != nil {
+			var fieldErrs ValidationErrors
+			if !errors.As(err, &fieldErrs) {
+				return NewHttpError(http.StatusUnprocessableEntity, err.Error()).WithCode("validation_failed").Wrap(err)
+			}
+			errs = fieldErrs
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return NewHttpError(http.StatusUnprocessableEntity, "validation failed").WithCode("validation_failed").WithExtra("errors", errs).Wrap(errs)
+}
+
+// bindFieldName returns the name of the field in the request, it is also used by the validation errors
+func bindFieldName(sf reflect.StructField) string {
+	for _, tag := range append([]string{"json"}, bindTagSources...) {
+		if name, _, _ := strings.Cut(sf.Tag.Get(tag), ","); name != "" && name != "-" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+// validateRulesChecked caches the results of checkValidateRules by the struct types
+var validateRulesChecked sync.Map
+
+type validateRulesResult struct {
+	err error
+}
+
+// checkValidateRules checks the "validate" tags of the struct fields, so the invalid rules are reported once per type
+func checkValidateRules(rt reflect.Type) error {
+	if result, ok := validateRulesChecked.Load(rt); ok {
+		return result.(validateRulesResult).err
+	}
+	var err error
+	for i := 0; i < rt.NumField() && err == nil; i++ {
+		sf := rt.Field(i)
+		if rules := sf.Tag.Get("validate"); rules != "" && rules != "-" {
+			for _, rule := range strings.Split(rules, ",") {
+				if err = checkValidateRule(sf.Type, strings.TrimSpace(rule)); err != nil {
+					err = fmt.Errorf("validate: field %s of %s: %w", sf.Name, rt, err)
+					break
+				}
+			}
+		}
+	}
+	validateRulesChecked.Store(rt, validateRulesResult{err: err})
+	return err
+}
+
+func checkValidateRule(ft reflect.Type, rule string) error {
+	name, arg, _ := strings.Cut(rule, "=")
+	if ft.Kind() == reflect.Pointer {
+		ft = ft.Elem()
+	}
+	switch name {
+	case "required", "oneof":
+		return nil
+	case "min", "max":
+		if _, err := strconv.ParseFloat(arg, 64); err != nil {
+			return fmt.Errorf("invalid validation rule %q", rule)
+		}
+		switch ft.Kind() {
+		case reflect.String, reflect.Slice, reflect.Array, reflect.Map,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return nil
+		}
+		return fmt.Errorf("min/max validation is not supported for %s", ft)
+	case "email":
+		if ft.Kind() == reflect.String {
+			return nil
+		}
+		return fmt.Errorf("email validation is not supported for %s", ft)
+	}
+	return fmt.Errorf("unknown validation rule %q", rule)
+}
+
+func validateValue(rv reflect.Value, prefix string, errs ValidationErrors) error {
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		rt := rv.Type()
+		if err := checkValidateRules(rt); err != nil {
+			return err
+		}
+		for i := 0; i < rt.NumField(); i++ {
+			sf := rt.Field(i)
+			if !sf.IsExported() && !(sf.Anonymous && sf.Type.Kind() == reflect.Struct) {
+				continue
+			}
+			name := prefix
+			if !sf.Anonymous {
+				name = prefix + bindFieldName(sf)
+			}
+			if msg := validateField(rv.Field(i), sf.Tag.Get("validate")); msg != "" {
+				errs[name] = msg
+				continue
+			}
+			if err := validateValue(rv.Field(i), fmutil.Iif(sf.Anonymous, prefix, name+"."), errs); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := validateValue(rv.Index(i), strings.TrimSuffix(prefix, ".")+"["+strconv.Itoa(i)+"].", errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateField checks a field by its rules (already checked by checkValidateRules), it returns the message of the first failed rule
+func validateField(fv reflect.Value, rules string) string {
+	if rules == "" || rules == "-" {
+		return ""
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		if name == "required" {
+			if fv.IsZero() {
+				return "is required"
+			}
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				return ""
+			}
+			fv = fv.Elem()
+		}
+		switch name {
+		case "min", "max":
+			limit, _ := strconv.ParseFloat(arg, 64)
+			value, isLength := validateMeasure(fv)
+			if (name == "min" && value < limit) || (name == "max" && value > limit) {
+				what := fmutil.Iif(name == "min", "at least", "at most")
+				if isLength {
+					return fmt.Sprintf("length must be %s %s", what, arg)
+				}
+				return fmt.Sprintf("must be %s %s", what, arg)
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			if !slices.Contains(options, fmt.Sprint(fv.Interface())) {
+				return "must be one of: " + strings.Join(options, ", ")
+			}
+		case "email":
+			if s := fv.String(); s != "" {
+				if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+					return "must be a valid email address"
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func validateMeasure(fv reflect.Value) (value float64, isLength bool) {
+	switch fv.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(fv.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(fv.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), false
+	}
+	return 0, false
+}
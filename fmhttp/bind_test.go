@@ -0,0 +1,143 @@
+package fmhttp
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBindPage struct {
+	Page int `query:"page" validate:"min=1"`
+}
+
+type testBindReq struct {
+	testBindPage
+	ID      int64     `path:"id"`
+	Tags    []string  `query:"tag"`
+	Since   time.Time `query:"since"`
+	Limit   *int      `query:"limit" validate:"max=100"`
+	TraceID string    `header:"X-Trace-Id"`
+	Name    string    `json:"name" form:"name" validate:"required,max=5"`
+	Email   string    `json:"email" form:"email" validate:"email"`
+	Sort    string    `json:"sort" validate:"oneof=asc desc"`
+	Items   []struct {
+		Qty int `json:"qty" validate:"min=1"`
+	} `json:"items"`
+}
+
+func TestBind(t *testing.T) {
+	hs := testHttpServer(&Options{UploadMaxRequestSize: 200})
+	r := NewRouter()
+	var got testBindReq
+	var bindErr error
+	r.Post("/users/{id}", func(c *Context) Response {
+		got = testBindReq{}
+		bindErr = c.Bind(&got)
+		return c.Respond("ok")
+	})
+	handler := hs.wrapHandlers(r)
+	serve := func(target, contentType, body string) {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Trace-Id", "t1")
+		testServeRequest(handler, req)
+	}
+
+	serve("/users/7?page=2&tag=a&tag=b&since=2024-01-02T03:04:05Z&limit=10", "application/json", `{"name":"bob","items":[{"qty":1}]}`)
+	assert.NoError(t, bindErr)
+	assert.EqualValues(t, 7, got.ID)
+	assert.EqualValues(t, 2, got.Page)
+	assert.EqualValues(t, []string{"a", "b"}, got.Tags)
+	assert.EqualValues(t, 2024, got.Since.Year())
+	assert.EqualValues(t, 10, *got.Limit)
+	assert.EqualValues(t, "t1", got.TraceID)
+	assert.EqualValues(t, "bob", got.Name)
+	assert.Len(t, got.Items, 1)
+
+	serve("/users/7", "application/x-www-form-urlencoded", "name=alice&email=a%40b.com")
+	assert.NoError(t, bindErr)
+	assert.EqualValues(t, "alice", got.Name)
+	assert.EqualValues(t, "a@b.com", got.Email)
+
+	serve("/users/7?page=x", "application/json", `{}`)
+	var httpErr *HttpError
+	assert.True(t, errors.As(bindErr, &httpErr))
+	assert.EqualValues(t, http.StatusBadRequest, httpErr.Status)
+	assert.Contains(t, httpErr.Detail, `"page"`)
+
+	serve("/users/7", "application/json", `{"name":`)
+	assert.True(t, errors.As(bindErr, &httpErr))
+	assert.EqualValues(t, "invalid_body", httpErr.Code)
+
+	// the form parsing errors are reported
+	serve("/users/7", "application/x-www-form-urlencoded", "name=%zz")
+	assert.True(t, errors.As(bindErr, &httpErr))
+	assert.EqualValues(t, http.StatusBadRequest, httpErr.Status)
+	assert.EqualValues(t, "invalid_body", httpErr.Code)
+
+	multipartBody := "--x\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\n" + strings.Repeat("a", 300) + "\r\n--x--\r\n"
+	serve("/users/7", "multipart/form-data; boundary=x", multipartBody)
+	assert.True(t, errors.As(bindErr, &httpErr))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, httpErr.Status)
+
+	// the JSON body is limited too
+	serve("/users/7", "application/json", `{"name":"`+strings.Repeat("a", 300)+`"}`)
+	assert.True(t, errors.As(bindErr, &httpErr))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, httpErr.Status)
+	assert.EqualValues(t, "body_too_large", httpErr.Code)
+}
+
+type testValidatorReq struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+func (r *testValidatorReq) Validate() error {
+	if r.From > r.To {
+		return ValidationErrors{"to": "must not be before from"}
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	limit := 101
+	req := &testBindReq{Name: "toolong", Email: "bad", Sort: "up", Limit: &limit}
+	req.Items = append(req.Items, struct {
+		Qty int `json:"qty" validate:"min=1"`
+	}{Qty: 0})
+	var httpErr *HttpError
+	assert.True(t, errors.As(Validate(req), &httpErr))
+	assert.EqualValues(t, http.StatusUnprocessableEntity, httpErr.Status)
+	assert.EqualValues(t, ValidationErrors{
+		"page":         "must be at least 1",
+		"limit":        "must be at most 100",
+		"name":         "length must be at most 5",
+		"email":        "must be a valid email address",
+		"sort":         "must be one of: asc, desc",
+		"items[0].qty": "must be at least 1",
+	}, httpErr.Extra["errors"])
+
+	assert.NoError(t, Validate(&testBindReq{testBindPage: testBindPage{Page: 1}, Name: "bob", Email: "bob@example.com", Sort: "asc"}))
+	assert.ErrorContains(t, Validate(&testBindReq{testBindPage: testBindPage{Page: 1}, Sort: "asc"}), "validation failed")
+
+	assert.NoError(t, Validate(&testValidatorReq{From: 1, To: 2}))
+	assert.True(t, errors.As(Validate(&testValidatorReq{From: 3, To: 2}), &httpErr))
+	assert.EqualValues(t, ValidationErrors{"to": "must not be before from"}, httpErr.Extra["errors"])
+
+	// the invalid rules are errors (not panics), they are not validation failures
+	type badRule struct {
+		Name string `validate:"nope"`
+	}
+	type badKind struct {
+		Flag bool `validate:"min=1"`
+	}
+	err := Validate(&badRule{})
+	assert.ErrorContains(t, err, `unknown validation rule "nope"`)
+	assert.False(t, errors.As(err, &httpErr))
+	assert.ErrorContains(t, Validate(&badRule{Name: "a"}), "field Name")
+	assert.ErrorContains(t, Validate([]badKind{{}}), "not supported for bool")
+}
@@ -0,0 +1,291 @@
+package fmhttp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	EncodingBrotli  = "br"
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+type CompressOptions struct {
+	// Encodings are the supported encodings in the preferred order, default is br, gzip and deflate
+	Encodings []string
+
+	// MinLength is the minimum body size to compress, default is 1024 bytes.
+	// The small bodies are buffered until the size is reached, a flush compresses the buffered data at once.
+	MinLength int
+
+	// SkipContentTypes are the content types (or prefixes ending with "/") which are already compressed,
+	// default is the images (except SVG), audios, videos, fonts, archives and event streams
+	SkipContentTypes []string
+}
+
+var compressDefaultOptions = CompressOptions{
+	Encodings: []string{EncodingBrotli, EncodingGzip, EncodingDeflate},
+	MinLength: 1024,
+	SkipContentTypes: []string{
+		"image/", "audio/", "video/", "font/woff", "font/woff2",
+		"application/zip", "application/gzip", "application/x-gzip", "application/x-brotli", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz", "application/x-bzip2",
+		"application/pdf", "text/event-stream",
+	},
+}
+
+// the compressors are reused by the pools, they are reset before writing
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+var compressorPools = map[string]*sync.Pool{
+	EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}},
+	EncodingGzip: {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	EncodingDeflate: {New: func() any {
+		w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return w
+	}},
+}
+
+func (opt *CompressOptions) skipContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, skip := range opt.SkipContentTypes {
+		if strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip) || mediaType == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding returns the supported encoding with the highest quality in Accept-Encoding,
+// the earlier one in opt.Encodings is used if the qualities are the same
+func (opt *CompressOptions) negotiateEncoding(acceptEncoding string) string {
+	items := parseAcceptHeader(strings.ToLower(acceptEncoding))
+	best, bestQ := "", 0.0
+	for _, encoding := range opt.Encodings {
+		q, found := 0.0, false
+		for _, item := range items {
+			if item.Value == encoding {
+				q, found = item.Q, true
+				break
+			} else if item.Value == "*" && !found {
+				q = item.Q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// Compress returns a middleware which compresses the response bodies by the encoding negotiated from Accept-Encoding.
+// The responses which already have a Content-Encoding, the range responses and the skipped content types are not compressed.
+func Compress(opts ...CompressOptions) func(ce *ChainExecutor) Response {
+	opt := fmutil.Def(opts, compressDefaultOptions)
+	opt.Encodings = fmutil.IfZero(opt.Encodings, compressDefaultOptions.Encodings)
+	opt.MinLength = fmutil.IfZero(opt.MinLength, compressDefaultOptions.MinLength)
+	opt.SkipContentTypes = fmutil.IfZero(opt.SkipContentTypes, compressDefaultOptions.SkipContentTypes)
+	for _, encoding := range opt.Encodings {
+		fmutil.MustTrue(compressorPools[encoding] != nil, "unsupported compression encoding: %s", encoding)
+	}
+
+	return func(ce *ChainExecutor) Response {
+		c := ce.context
+		c.ResponseWriter.Header().Add("Vary", "Accept-Encoding")
+		encoding := opt.negotiateEncoding(c.Request.Header.Get("Accept-Encoding"))
+		if encoding == "" || c.Request.Method == http.MethodHead {
+			return ce.Next()
+		}
+
+		origWriter := c.ResponseWriter.responseWriter
+		cw := &compressWriter{ResponseWriter: origWriter, opt: &opt, encoding: encoding}
+		c.ResponseWriter.responseWriter = cw
+		// the panic response is written without compression, it could still be responded if nothing has been sent
+		abort := func() {
+			c.ResponseWriter.responseWriter = origWriter
+			if cw.abort() {
+				c.ResponseWriter.statusCode, c.ResponseWriter.written = 0, 0
+			}
+		}
+		panicked := true
+		defer func() {
+			if panicked {
+				abort()
+			}
+		}()
+		resp := ce.Next()
+		panicked = false
+		if resp == nil || resp == responseNop {
+			// the handler has written the response by itself
+			_ = cw.Close()
+			return resp
+		}
+		return &compressResponse{Response: resp, cw: cw, abort: abort}
+	}
+}
+
+type compressResponse struct {
+	Response
+	cw    *compressWriter
+	abort func()
+}
+
+func (r *compressResponse) RespondTo(w http.ResponseWriter) (int64, error) {
+	panicked := true
+	defer func() {
+		if panicked {
+			r.abort()
+		}
+	}()
+	n, err := r.Response.RespondTo(w)
+	panicked = false
+	return n, errors.Join(err, r.cw.Close())
+}
+
+// compressWriter buffers the body until MinLength is reached, then it decides whether to compress by the headers.
+type compressWriter struct {
+	http.ResponseWriter
+	opt      *CompressOptions
+	encoding string
+
+	statusCode int
+	buf        bytes.Buffer
+	decided    bool
+	compressor compressor
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.decided || statusCode < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	cw.statusCode = statusCode
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.compressor != nil {
+			return cw.compressor.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf.Write(p)
+	if cw.buf.Len() >= cw.opt.MinLength {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *compressWriter) shouldCompress() bool {
+	h := cw.Header()
+	switch {
+	case cw.statusCode == http.StatusNoContent || cw.statusCode == http.StatusNotModified || cw.statusCode == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "":
+		return false
+	}
+	if h.Get(headerContentType) == "" {
+		// the compressed data can't be sniffed by net/http
+		h.Set(headerContentType, http.DetectContentType(cw.buf.Bytes()))
+	}
+	return !cw.opt.skipContentType(h.Get(headerContentType))
+}
+
+// decide writes the header and the buffered data, the data is compressed if it is large enough (or it is flushed)
+func (cw *compressWriter) decide(largeEnough bool) error {
+	cw.decided = true
+	if largeEnough && cw.shouldCompress() {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// the compressed body is different from the original one, so a strong ETag becomes weak
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.compressor = compressorPools[cw.encoding].Get().(compressor)
+		cw.compressor.Reset(cw.ResponseWriter)
+	}
+	if cw.statusCode != 0 {
+		cw.ResponseWriter.WriteHeader(cw.statusCode)
+	}
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf = bytes.Buffer{}
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		_ = cw.decide(cw.buf.Len() != 0)
+	}
+	if cw.compressor != nil {
+		_ = cw.compressor.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the remaining data, the small body is not compressed
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.compressor == nil {
+		return nil
+	}
+	err := cw.compressor.Close()
+	cw.compressor.Reset(io.Discard)
+	compressorPools[cw.encoding].Put(cw.compressor)
+	cw.compressor = nil
+	return err
+}
+
+// abort drops the buffered data and returns the compressor to the pool without finishing the body,
+// it reports whether nothing has been sent
+func (cw *compressWriter) abort() bool {
+	cw.buf = bytes.Buffer{}
+	if cw.compressor != nil {
+		cw.compressor.Reset(io.Discard)
+		compressorPools[cw.encoding].Put(cw.compressor)
+		cw.compressor = nil
+	}
+	return !cw.decided
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
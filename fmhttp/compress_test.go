@@ -0,0 +1,135 @@
+package fmhttp
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCompressNegotiateEncoding(t *testing.T) {
+	opt := compressDefaultOptions
+	assert.EqualValues(t, "br", opt.negotiateEncoding("gzip, deflate, br"))
+	assert.EqualValues(t, "gzip", opt.negotiateEncoding("br;q=0.5, gzip"))
+	assert.EqualValues(t, "br", opt.negotiateEncoding("*"))
+	assert.EqualValues(t, "gzip", opt.negotiateEncoding("br;q=0, *;q=0.1"))
+	assert.EqualValues(t, "", opt.negotiateEncoding("identity"))
+	assert.EqualValues(t, "", opt.negotiateEncoding(""))
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+	hs := testHttpServer(&Options{AssetsFS: fstest.MapFS{
+		"assets/web/large.txt": {Data: []byte(large)},
+	}})
+	r := NewRouter()
+	r.Use(Compress())
+	r.Get("/large", func(c *Context) Response {
+		return c.Respond(large)
+	})
+	r.Get("/small", func(c *Context) Response {
+		return c.Respond("small")
+	})
+	r.Get("/png", func(c *Context) Response {
+		resp := c.Respond(large)
+		resp.Header().Set("Content-Type", "image/png")
+		return resp
+	})
+	r.Get("/direct", func(c *Context) Response {
+		_, _ = c.ResponseWriter.Write([]byte(large))
+		return responseNop
+	})
+	r.Get("/large.txt", hs.ServeAssetFile)
+	handler := hs.wrapHandlers(r)
+
+	w := testServe(handler, "GET", "/large", "Accept-Encoding", "gzip")
+	assert.EqualValues(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.EqualValues(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	gr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(gr)
+	assert.EqualValues(t, large, string(body))
+
+	// the pooled compressors are reused
+	for i := 0; i < 3; i++ {
+		w = testServe(handler, "GET", "/direct", "Accept-Encoding", "br")
+		assert.EqualValues(t, "br", w.Header().Get("Content-Encoding"))
+		body, _ = io.ReadAll(brotli.NewReader(w.Body))
+		assert.EqualValues(t, large, string(body))
+	}
+
+	w = testServe(handler, "GET", "/small", "Accept-Encoding", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "small", w.Body.String())
+
+	w = testServe(handler, "GET", "/png", "Accept-Encoding", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, large, w.Body.String())
+
+	w = testServe(handler, "GET", "/large", "Accept-Encoding", "")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	w = testServe(handler, "GET", "/large.txt", "Accept-Encoding", "gzip")
+	assert.EqualValues(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Content-Length"))
+
+	// the range response of the file is not compressed
+	w = testServe(handler, "GET", "/large.txt", "Accept-Encoding", "gzip", "Range", "bytes=0-4")
+	assert.EqualValues(t, http.StatusPartialContent, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "hello", w.Body.String())
+}
+
+type testPanicResponse struct {
+	Response
+	body string
+}
+
+func (r *testPanicResponse) RespondTo(w http.ResponseWriter) (int64, error) {
+	_, _ = w.Write([]byte(r.body))
+	panic("respond failed")
+}
+
+func TestCompressPanic(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Use(Compress())
+	r.Get("/buffered", func(c *Context) Response {
+		return &testPanicResponse{Response: c.Respond(""), body: "partial"}
+	})
+	r.Get("/sent", func(c *Context) Response {
+		return &testPanicResponse{Response: c.Respond(""), body: large}
+	})
+	r.Get("/middleware", func(c *Context) Response {
+		_, _ = c.ResponseWriter.Write([]byte("partial"))
+		panic("handle failed")
+	})
+	handler := hs.wrapHandlers(r)
+
+	// nothing has been sent, the error is responded without compression
+	for _, target := range []string{"/buffered", "/middleware"} {
+		w := testServe(handler, "GET", target, "Accept-Encoding", "gzip")
+		assert.EqualValues(t, http.StatusInternalServerError, w.Code, target)
+		assert.Empty(t, w.Header().Get("Content-Encoding"), target)
+		assert.NotContains(t, w.Body.String(), "partial", target)
+	}
+
+	// the compressed body has been sent, it is truncated
+	w := testServe(handler, "GET", "/sent", "Accept-Encoding", "gzip")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	cw := &compressWriter{ResponseWriter: httptest.NewRecorder(), opt: &compressDefaultOptions, encoding: EncodingGzip}
+	_, _ = cw.Write([]byte(large))
+	assert.NotNil(t, cw.compressor)
+	assert.False(t, cw.abort())
+	assert.Nil(t, cw.compressor)
+}
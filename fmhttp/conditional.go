@@ -0,0 +1,154 @@
+package fmhttp
+
+import (
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl sets the Cache-Control header, eg: "private, max-age=60"
+func (wr *ResponseCommon) CacheControl(v string) *ResponseCommon {
+	wr.Header().Set("Cache-Control", v)
+	return wr
+}
+
+// LastModified sets the Last-Modified header, the If-Modified-Since and If-Unmodified-Since requests are evaluated by it
+func (wr *ResponseCommon) LastModified(t time.Time) *ResponseCommon {
+	if !t.IsZero() {
+		wr.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	return wr
+}
+
+// Vary adds the request headers which affect the response, the duplicate ones are ignored
+func (wr *ResponseCommon) Vary(headers ...string) *ResponseCommon {
+	for _, header := range headers {
+		header = http.CanonicalHeaderKey(header)
+		if !slices.Contains(wr.Header().Values("Vary"), header) {
+			wr.Header().Add("Vary", header)
+		}
+	}
+	return wr
+}
+
+// ETag sets the entity tag by a version of the resource, eg: ETag(strconv.FormatInt(user.Version, 10)).
+// A version without quotes is quoted as a strong ETag, a weak one could be set like `W/"v1"`.
+// Without it, a weak ETag is generated from the body of the buffered GET responses.
+func (wr *ResponseCommon) ETag(version string) *ResponseCommon {
+	wr.Header().Set("ETag", quoteETag(version))
+	return wr
+}
+
+func quoteETag(version string) string {
+	if strings.HasPrefix(version, `"`) || strings.HasPrefix(version, `W/"`) {
+		return version
+	}
+	return `"` + version + `"`
+}
+
+func bodyETag(body []byte) string {
+	h := fnv.New64a()
+	_, _ = h.Write(body)
+	return `W/"` + strconv.FormatUint(h.Sum64(), 36) + `"`
+}
+
+// etagMatch checks the ETag with the If-Match (strong) or If-None-Match (weak) header: `"a", W/"b"` or "*"
+func etagMatch(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluatePreconditions evaluates the conditional request headers by the response's ETag and Last-Modified (RFC 9110 13.2.2),
+// it returns 304, 412 or 0 if the request should be processed normally
+func evaluatePreconditions(r *http.Request, h http.Header) int {
+	etag := h.Get("ETag")
+	lastModified, _ := http.ParseTime(h.Get("Last-Modified"))
+	isGetOrHead := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagMatch(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !lastModified.IsZero() {
+		if lastModified.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagMatch(ifNoneMatch, etag, true) {
+			if isGetOrHead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && isGetOrHead && !lastModified.IsZero() {
+		if !lastModified.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// writeBuffered writes a complete body with Content-Length. For the successful GET/HEAD responses, a weak ETag is
+// generated if the handler doesn't set one, and the conditional requests are responded by 304 or 412 without the body.
+func writeBuffered(c *Context, w http.ResponseWriter, statusCode int, body []byte) (int64, error) {
+	h := w.Header()
+	r := c.Request
+	if (statusCode == 0 || statusCode == http.StatusOK) && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if h.Get("ETag") == "" && !strings.Contains(h.Get("Cache-Control"), "no-store") {
+			h.Set("ETag", bodyETag(body))
+		}
+		if status := evaluatePreconditions(r, h); status != 0 {
+			h.Del(headerContentType)
+			h.Del("Content-Length")
+			w.WriteHeader(status)
+			return 0, nil
+		}
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if statusCode != 0 {
+		w.WriteHeader(statusCode)
+	}
+	n, err := w.Write(body)
+	return int64(n), err
+}
+
+// CheckPreconditions evaluates the conditional request headers by the current version of the resource before
+// modifying it, eg: a PUT request with "If-Match" for optimistic locking. It returns a 304 or 412 response
+// if the handler should stop, otherwise it returns nil.
+func (c *Context) CheckPreconditions(etag string, lastModified time.Time) Response {
+	resp := c.Respond().LastModified(lastModified)
+	if etag != "" {
+		resp.ETag(etag)
+	}
+	if status := evaluatePreconditions(c.Request, resp.Header()); status != 0 {
+		return resp.SetStatusCode(status)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestETagMatch(t *testing.T) {
+	assert.True(t, etagMatch(`"a", W/"b"`, `W/"b"`, true))
+	assert.False(t, etagMatch(`"a", W/"b"`, `W/"b"`, false))
+	assert.True(t, etagMatch(`"a"`, `W/"a"`, true))
+	assert.False(t, etagMatch(`"a"`, `W/"a"`, false))
+	assert.True(t, etagMatch(`"x", "a"`, `"a"`, false))
+	assert.True(t, etagMatch(`*`, `"a"`, false))
+	assert.False(t, etagMatch(`*`, ``, false))
+}
+
+func TestConditionalResponse(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := NewRouter()
+	r.Get("/json", func(c *Context) Response {
+		return c.RespondJson(map[string]any{"a": 1}).CacheControl("private, max-age=60").Vary("Accept", "accept")
+	})
+	r.Get("/versioned", func(c *Context) Response {
+		return c.Respond("body").ETag("v2").LastModified(modTime)
+	})
+	r.Put("/versioned", func(c *Context) Response {
+		if resp := c.CheckPreconditions(`"v2"`, modTime); resp != nil {
+			return resp
+		}
+		return c.Respond("updated")
+	})
+	handler := hs.wrapHandlers(r)
+
+	w := testServe(handler, "GET", "/json")
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^W/".+"$`, etag)
+	assert.EqualValues(t, "7", w.Header().Get("Content-Length"))
+	assert.EqualValues(t, "private, max-age=60", w.Header().Get("Cache-Control"))
+	assert.EqualValues(t, []string{"Accept"}, w.Header().Values("Vary"))
+
+	w = testServe(handler, "GET", "/json", "If-None-Match", `"other", `+etag)
+	assert.EqualValues(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.EqualValues(t, etag, w.Header().Get("ETag"))
+
+	w = testServe(handler, "GET", "/versioned")
+	assert.EqualValues(t, `"v2"`, w.Header().Get("ETag"))
+	assert.EqualValues(t, "body", w.Body.String())
+	assert.EqualValues(t, http.StatusNotModified, testServe(handler, "GET", "/versioned", "If-None-Match", `W/"v2"`).Code)
+	assert.EqualValues(t, http.StatusNotModified, testServe(handler, "GET", "/versioned", "If-Modified-Since", modTime.Format(http.TimeFormat)).Code)
+	assert.EqualValues(t, http.StatusOK, testServe(handler, "GET", "/versioned", "If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat)).Code)
+	assert.EqualValues(t, http.StatusPreconditionFailed, testServe(handler, "GET", "/versioned", "If-Match", `"v1"`).Code)
+
+	assert.EqualValues(t, http.StatusPreconditionFailed, testServe(handler, "PUT", "/versioned", "If-Match", `"v1"`).Code)
+	assert.EqualValues(t, http.StatusPreconditionFailed, testServe(handler, "PUT", "/versioned", "If-Unmodified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat)).Code)
+	w = testServe(handler, "PUT", "/versioned", "If-Match", `"v2"`)
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "updated", w.Body.String())
+	assert.Empty(t, w.Header().Get("ETag"))
+}
@@ -26,6 +26,9 @@ type Context struct {
 	session     *Session
 	queryValues url.Values
 	pathParams  []string
+	locale      string
+	// errorDepth is the depth of the nested error responses, the ErrorHandler may respond an error again
+	errorDepth int
 
 	HandlerData map[string]any
 }
@@ -62,11 +65,25 @@ func (c *Context) Session() *Session {
 			// the FilesystemStore may return error if the cookie file doesn't exist. And the session is always returned.
 			lowSession, _ := c.HttpServer.sessionStore.Get(c.Request, c.HttpServer.sessionCookieName)
 			c.session = NewSession(lowSession)
+			c.session.enforceTimeouts(c.HttpServer.sessionIdleTimeout, c.HttpServer.sessionAbsoluteTimeout)
 		}
 	}
 	return c.session
 }
 
+// hasSession returns whether the session is loaded or the request has a session cookie,
+// the requests without a session don't need to load (and create) one for reading
+func (c *Context) hasSession() bool {
+	if c.HttpServer == nil || c.HttpServer.sessionStore == nil {
+		return false
+	}
+	if c.session != nil {
+		return true
+	}
+	_, err := c.Request.Cookie(c.HttpServer.sessionCookieName)
+	return err == nil
+}
+
 func (c *Context) Respond(vars ...any) *ResponseCommon {
 	wr := &ResponseCommon{request: c}
 	for _, v0 := range vars {
@@ -118,9 +135,10 @@ func (c *Context) RespondJson(v any) *ResponseCommon {
 
 func (c *Context) RespondTmpl(name string, data map[string]any) *ResponseCommon {
 	return c.Respond(responderTmpl{
-		req:  c,
-		name: name,
-		data: data,
+		req:    c,
+		name:   name,
+		data:   data,
+		locale: c.Locale(),
 	})
 }
 
@@ -143,7 +161,7 @@ func (c *Context) IsResponseWritten() bool {
 func (c *Context) UriHost() string {
 	schema := c.Request.Header.Get("X-Forwarded-Proto")
 	schema = fmutil.IfZero(schema, "http")
-	if c.Request.Header.Get("HTTPS") == "on" {
+	if c.Request.TLS != nil || c.Request.Header.Get("HTTPS") == "on" {
 		schema = "https"
 	}
 	return schema + "://" + c.Request.Host
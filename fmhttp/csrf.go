@@ -0,0 +1,142 @@
+package fmhttp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	sessionKeyCsrfToken = "__fm_csrf_token"
+	csrfTokenLength     = 32
+
+	// TmplDataKeyCsrfToken is the template data key of the masked CSRF token, it is set by the Csrf middleware
+	TmplDataKeyCsrfToken     = "CsrfToken"
+	TmplDataKeyCsrfFieldName = "CsrfFieldName"
+)
+
+type CsrfOptions struct {
+	// FieldName is the form field of the token, default is "_csrf".
+	// The multipart bodies are parsed with the server's upload limits to read the field, SaveFormFiles saves the parsed files then.
+	FieldName string
+	// HeaderName is the request header of the token, default is "X-CSRF-Token"
+	HeaderName string
+	// AllowQueryToken accepts the token in the URL query by FieldName, eg: action="/upload?_csrf={{csrfToken .}}".
+	// The URLs may be recorded by the access logs, the browser history and the Referer header, so it's disabled by default.
+	AllowQueryToken bool
+
+	// ErrorHandler responds when the token is invalid, default is a 403 response
+	ErrorHandler RequestHandlerFunc
+
+	// ExemptPaths are not checked, eg: webhook endpoints. A path ending with "*" matches the paths with the prefix.
+	ExemptPaths []string
+}
+
+var csrfDefaultOptions = CsrfOptions{
+	FieldName:  "_csrf",
+	HeaderName: "X-CSRF-Token",
+	ErrorHandler: func(c *Context) Response {
+		return c.Respond(NewHttpError(http.StatusForbidden, "invalid CSRF token").WithCode("csrf_invalid"))
+	},
+}
+
+func (opt *CsrfOptions) isExempt(path string) bool {
+	for _, p := range opt.ExemptPaths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+// Csrf returns a middleware which validates the per-session token for the unsafe methods (POST, PUT, etc).
+// The masked token is put into HandlerData, templates could use it by {{csrfField .}} or {{csrfToken .}}
+// (or `$` instead of `.` inside range/with).
+func Csrf(opts ...CsrfOptions) func(ce *ChainExecutor) Response {
+	opt := fmutil.Def(opts, csrfDefaultOptions)
+	opt.FieldName = fmutil.IfZero(opt.FieldName, csrfDefaultOptions.FieldName)
+	opt.HeaderName = fmutil.IfZero(opt.HeaderName, csrfDefaultOptions.HeaderName)
+	if opt.ErrorHandler == nil {
+		opt.ErrorHandler = csrfDefaultOptions.ErrorHandler
+	}
+
+	return func(ce *ChainExecutor) Response {
+		c := ce.context
+		session := c.Session()
+		fmutil.MustTrue(session != nil, "csrf middleware requires session")
+
+		realToken, _ := base64.RawURLEncoding.DecodeString(session.GetString(sessionKeyCsrfToken))
+		if len(realToken) != csrfTokenLength {
+			realToken = make([]byte, csrfTokenLength)
+			_, err := rand.Read(realToken)
+			fmutil.MustNoError(err)
+			session.Set(sessionKeyCsrfToken, base64.RawURLEncoding.EncodeToString(realToken))
+		}
+
+		if !isSafeMethod(c.Request.Method) && !opt.isExempt(c.Request.URL.Path) {
+			sentToken := c.Request.Header.Get(opt.HeaderName)
+			if sentToken == "" && opt.AllowQueryToken {
+				sentToken = c.QueryParam(opt.FieldName)
+			}
+			if sentToken == "" {
+				if err := c.parseForm(); err != nil {
+					return c.Respond(err)
+				}
+				sentToken = c.Request.PostForm.Get(opt.FieldName)
+			}
+			if !csrfTokenValid(realToken, sentToken) {
+				return opt.ErrorHandler(c)
+			}
+		}
+
+		if c.HandlerData == nil {
+			c.HandlerData = map[string]any{}
+		}
+		c.HandlerData[TmplDataKeyCsrfToken] = csrfMaskToken(realToken)
+		c.HandlerData[TmplDataKeyCsrfFieldName] = opt.FieldName
+		return ce.Next()
+	}
+}
+
+// csrfMaskToken generates a different token for every response to mitigate the BREACH attack: base64(mask + (mask XOR token))
+func csrfMaskToken(realToken []byte) string {
+	buf := make([]byte, 2*csrfTokenLength)
+	_, err := rand.Read(buf[:csrfTokenLength])
+	fmutil.MustNoError(err)
+	for i := 0; i < csrfTokenLength; i++ {
+		buf[csrfTokenLength+i] = buf[i] ^ realToken[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func csrfTokenValid(realToken []byte, sentToken string) bool {
+	buf, err := base64.RawURLEncoding.DecodeString(sentToken)
+	if err != nil || len(buf) != 2*csrfTokenLength {
+		return false
+	}
+	for i := 0; i < csrfTokenLength; i++ {
+		buf[i] ^= buf[csrfTokenLength+i]
+	}
+	return subtle.ConstantTimeCompare(buf[:csrfTokenLength], realToken) == 1
+}
+
+func tmplFuncCsrfToken(data map[string]any) string {
+	return fmutil.AsString(data[TmplDataKeyCsrfToken])
+}
+
+func tmplFuncCsrfField(data map[string]any) template.HTML {
+	fieldName := fmutil.AsString(data[TmplDataKeyCsrfFieldName], csrfDefaultOptions.FieldName)
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(fieldName) + `" value="` + template.HTMLEscapeString(tmplFuncCsrfToken(data)) + `">`)
+}
@@ -0,0 +1,55 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCsrf(t *testing.T) {
+	hs := testHttpServer(&Options{
+		SessionCookieName:      "test-session",
+		SessionCookieSecureKey: "test-hash-key",
+		SessionStoreType:       SessionStoreMemory,
+	})
+	r := NewRouter()
+	r.Use(Csrf(CsrfOptions{ExemptPaths: []string{"/webhook/*"}}))
+	r.Get("/form", func(c *Context) Response {
+		return c.Respond(200, c.HandlerData[TmplDataKeyCsrfToken].(string))
+	})
+	r.Post("/form", testResp(200))
+	r.Post("/webhook/github", testResp(200))
+	handler := hs.wrapHandlers(r)
+
+	w := testServeRequest(handler, httptest.NewRequest("GET", "/form", nil))
+	cookies := w.Result().Cookies()
+	token := w.Body.String()
+	assert.NotEmpty(t, token)
+	assert.Len(t, cookies, 1)
+
+	// every response has a different masked token for the same session token
+	token2 := testServeRequest(handler, httptest.NewRequest("GET", "/form", nil), cookies...).Body.String()
+	assert.NotEqualValues(t, token, token2)
+
+	w = testServeRequest(handler, httptest.NewRequest("POST", "/form", nil), cookies...)
+	assert.EqualValues(t, http.StatusForbidden, w.Code)
+
+	req := httptest.NewRequest("POST", "/form", nil)
+	req.Header.Set("X-CSRF-Token", token2)
+	assert.EqualValues(t, 200, testServeRequest(handler, req, cookies...).Code)
+
+	req = httptest.NewRequest("POST", "/form", strings.NewReader(url.Values{"_csrf": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.EqualValues(t, 200, testServeRequest(handler, req, cookies...).Code)
+
+	// a token of another session is rejected
+	w = testServeRequest(handler, httptest.NewRequest("GET", "/form", nil))
+	req = httptest.NewRequest("POST", "/form", nil)
+	req.Header.Set("X-CSRF-Token", w.Body.String())
+	assert.EqualValues(t, http.StatusForbidden, testServeRequest(handler, req, cookies...).Code)
+
+	assert.EqualValues(t, 200, testServeRequest(handler, httptest.NewRequest("POST", "/webhook/github", nil)).Code)
+}
@@ -19,6 +19,8 @@ var typeResponseWriter = reflect.TypeOf((*http.ResponseWriter)(nil)).Elem()
 var typeGoHttpRequestPtr = reflect.TypeOf(&http.Request{})
 
 type HandlerCaller struct {
+	// source is the RequestHandler which provides p, eg: *TypedHandler for the API documents
+	source   RequestHandler
 	p        AnyHandler
 	pv       reflect.Value
 	pt       reflect.Type
@@ -121,7 +123,9 @@ func (ch *handlerChain) addEndpoint(h ...AnyHandler) *handlerChain {
 		case *handlerChain:
 			ch.middlewares = append(ch.middlewares, h.middlewares...)
 		case RequestHandler:
-			ch.middlewares = append(ch.middlewares, NewHandlerCaller(h.Handle))
+			hc := NewHandlerCaller(h.Handle)
+			hc.source = h
+			ch.middlewares = append(ch.middlewares, hc)
 		default:
 			ch.middlewares = append(ch.middlewares, NewHandlerCaller(p))
 		}
@@ -0,0 +1,25 @@
+package fmhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// testServe serves a request without body by the handler, the headers are name-value pairs, eg: testServe(h, "GET", "/", "Accept", "text/html")
+func testServe(h http.Handler, method, target string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return testServeRequest(h, req)
+}
+
+// testServeRequest serves the request with the cookies by the handler and returns the recorded response
+func testServeRequest(h http.Handler, req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
@@ -2,9 +2,13 @@ package fmhttp
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmorm"
 	"github.com/go-farmyard/farmyard/fmutil"
 	"github.com/gorilla/sessions"
+	"html/template"
 	"io"
 	"io/fs"
 	"net"
@@ -12,7 +16,10 @@ import (
 	"os"
 	"reflect"
 	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 type contextWrappedType struct{}
@@ -33,8 +40,19 @@ type HttpServer struct {
 	sessionCookieName    string
 	sessionCookieOptions *sessions.Options
 
+	sessionIdleTimeout     time.Duration
+	sessionAbsoluteTimeout time.Duration
+
 	assetFS    fs.FS
 	tmplRender *TemplateRender
+	assets     *AssetPipeline
+	tmplFuncs  template.FuncMap
+
+	errorTemplate string
+
+	i18n             *I18n
+	localeQueryParam string
+	localeCookieName string
 
 	AssetsDir     fs.FS
 	AssetsWebRoot fs.FS
@@ -42,22 +60,111 @@ type HttpServer struct {
 	commonMiddlewares handlerChain
 	WrapContext       func(r *Context) AnyContext
 
+	// ErrorHandler responds the errors returned by the handlers (c.Respond(err)) and the panics, default is DefaultErrorHandler.
+	// It must not respond an error (eg: c.Respond(err)), such a nested error is responded by DefaultErrorHandler,
+	// or as plain text if DefaultErrorHandler fails too.
+	ErrorHandler  func(c *Context, err error) Response
+	errorMappings []errorMapping
+	errorMapFuncs []func(err error) *HttpError
+
 	realIpHeader        string
 	trustHttpHeaderFrom []*net.IPNet
+
+	uploadMaxMemory      int64
+	uploadMaxFileSize    int64
+	uploadMaxRequestSize int64
+
+	tlsEnabled      bool
+	shutdownTimeout time.Duration
+	listenOpts      []ListenOptions
+	listenersMu     sync.Mutex
+	listeners       []net.Listener
+	servers         []*http.Server
+	onStartHooks    []LifecycleHook
+	onStopHooks     []LifecycleHook
 }
 
 type Options struct {
 	DevMode  bool
 	Listen   string
 	AssetsFS fs.FS
-
-	SessionDir             string
-	SessionCookieSecureKey string
-	SessionCookieName      string
-	SessionCookieOptions   *sessions.Options
+	// AssetsUrlPrefix is the URL prefix of the "asset" template function, eg: a CDN "https://cdn.example.com", default is "/"
+	AssetsUrlPrefix string
+
+	TemplateFuncs template.FuncMap
+	// PrecompileTemplates parses all templates at startup, the server fails to start if any template is broken
+	PrecompileTemplates bool
+	// ErrorTemplate renders the error responses for browsers and the failed template renderings, the data has "StatusCode"
+	// and "Error" (*HttpError). In DevMode, a detailed error page is shown for the failed template renderings instead.
+	ErrorTemplate string
+
+	// DefaultLocale is used when no requested locale is available, default is "en".
+	// The message catalogs are loaded from the "locale" directory of the assets, see I18n.LoadFS.
+	DefaultLocale string
+	// LocaleQueryParam and LocaleCookieName select the locale of a request, default are both "lang"
+	LocaleQueryParam string
+	LocaleCookieName string
+	// LocaleFallbacks are the locales tried after a locale, see I18n.Fallbacks
+	LocaleFallbacks map[string][]string
+
+	// Listeners are used by Run instead of Listen to serve on multiple addresses concurrently
+	Listeners []ListenOptions
+
+	SessionDir              string
+	SessionCookieSecureKey  string
+	SessionCookieEncryptKey string
+	SessionCookieName       string
+	// SessionCookieOptions defaults to HttpOnly, SameSite=Lax and Secure cookies
+	SessionCookieOptions *sessions.Options
+	// SessionCookieInsecure sends the default session cookie over plain HTTP too.
+	// The default cookie used to be not Secure, the servers only accessed by plain HTTP (except localhost) need to set it.
+	SessionCookieInsecure bool
+
+	// SessionCookieKeys are used to sign (and encrypt) the session cookies, the first one is used to encode the cookies,
+	// the others are only used to decode, so the keys can be rotated without logging everyone out.
+	// SessionCookieSecureKey and SessionCookieEncryptKey are used as the last key pair if they are set.
+	SessionCookieKeys []SessionKeyPair
+
+	// SessionIdleTimeout and SessionAbsoluteTimeout are enforced by the server, the expired session is cleared
+	SessionIdleTimeout     time.Duration
+	SessionAbsoluteTimeout time.Duration
+
+	// SessionStore is a custom session store, if it is nil, the store is created by SessionStoreType (default is filesystem)
+	SessionStore     sessions.Store
+	SessionStoreType SessionStoreType
+	SessionOrm       *fmorm.Orm
+	SessionSqlTable  string
 
 	RealIpHeader        string
 	TrustHttpHeaderFrom []string
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// TlsCertFile and TlsKeyFile enable TLS, they are read from TlsFS if it is set, otherwise from the OS filesystem.
+	// The changed files are reloaded without restarting the server, they are checked every TlsReloadInterval (default 10s).
+	TlsCertFile       string
+	TlsKeyFile        string
+	TlsFS             fs.FS
+	TlsReloadInterval time.Duration
+
+	// TlsClientCAFile enables client certificate verification (mTLS), TlsClientAuth defaults to RequireAndVerifyClientCert
+	TlsClientCAFile string
+	TlsClientAuth   tls.ClientAuthType
+
+	EnableHttp2 bool
+
+	// UploadMaxMemory, UploadMaxFileSize and UploadMaxRequestSize are the default limits of the uploads, see UploadOptions.
+	// The defaults are 32MB memory, no limit per file and 100MB per request.
+	UploadMaxMemory      int64
+	UploadMaxFileSize    int64
+	UploadMaxRequestSize int64
+
+	// ShutdownTimeout is the grace period for in-flight requests when the server is stopping, default is 30 seconds
+	ShutdownTimeout time.Duration
 }
 
 func NewHttpServer(opt *Options) *HttpServer {
@@ -68,10 +175,28 @@ func NewHttpServer(opt *Options) *HttpServer {
 		sessionCookieOptions: opt.SessionCookieOptions,
 
 		assetFS:   opt.AssetsFS,
+		tmplFuncs: opt.TemplateFuncs,
 		serverMux: http.NewServeMux(),
 
+		errorTemplate: opt.ErrorTemplate,
+
+		i18n:             NewI18n(fmutil.IfZero(opt.DefaultLocale, defaultLocale)),
+		localeQueryParam: fmutil.IfZero(opt.LocaleQueryParam, "lang"),
+		localeCookieName: fmutil.IfZero(opt.LocaleCookieName, "lang"),
+
 		realIpHeader: opt.RealIpHeader,
+		listenOpts:   opt.Listeners,
+
+		uploadMaxMemory:      fmutil.IfZero(opt.UploadMaxMemory, defaultUploadMaxMemory),
+		uploadMaxFileSize:    opt.UploadMaxFileSize,
+		uploadMaxRequestSize: fmutil.IfZero(opt.UploadMaxRequestSize, defaultUploadMaxRequestSize),
+
+		shutdownTimeout: fmutil.IfZero(opt.ShutdownTimeout, defaultShutdownTimeout),
+
+		ErrorHandler:  DefaultErrorHandler,
+		errorMappings: slices.Clone(defaultErrorMappings),
 	}
+	hs.i18n.Fallbacks = opt.LocaleFallbacks
 
 	for _, ipCidr := range opt.TrustHttpHeaderFrom {
 		ipCidr = strings.TrimSpace(ipCidr)
@@ -86,13 +211,24 @@ func NewHttpServer(opt *Options) *HttpServer {
 	hs.server = &http.Server{
 		Addr:    opt.Listen,
 		Handler: hs.serverMux,
+
+		ReadTimeout:       opt.ReadTimeout,
+		ReadHeaderTimeout: opt.ReadHeaderTimeout,
+		WriteTimeout:      opt.WriteTimeout,
+		IdleTimeout:       opt.IdleTimeout,
+		MaxHeaderBytes:    opt.MaxHeaderBytes,
 	}
 
+	hs.initTls(opt)
 	hs.initAssetsDir()
+	hs.tmplRender.AssetsUrlPrefix = opt.AssetsUrlPrefix
+	if opt.PrecompileTemplates {
+		if err := hs.tmplRender.Precompile(); err != nil {
+			fmlog.Fatalf("failed to precompile templates, err:\n%v", err)
+		}
+	}
 	if opt.SessionCookieName != "" {
-		ss := sessions.NewFilesystemStore(opt.SessionDir, []byte(opt.SessionCookieSecureKey))
-		ss.Options = hs.sessionCookieOptions
-		hs.sessionStore = ss
+		hs.initSessionStore(opt)
 	}
 	return hs
 }
@@ -115,6 +251,11 @@ func (hs *HttpServer) initAssetsDir() {
 		fmlog.Fatalf("can not open web directory for http server, err:%v", err)
 	}
 
+	hs.assets, err = NewAssetPipeline(hs.AssetsWebRoot, !hs.devMode)
+	if err != nil {
+		fmlog.Fatalf("can not compute the hashes of the assets, err:%v", err)
+	}
+
 	assetsTmplRoot, err := fs.Sub(hs.AssetsDir, "template")
 	if err != nil {
 		fmlog.Fatalf("can not open template directory for http server, err:%v", err)
@@ -122,6 +263,21 @@ func (hs *HttpServer) initAssetsDir() {
 
 	hs.tmplRender = NewTemplateRender(assetsTmplRoot)
 	hs.tmplRender.DevMode = hs.devMode
+	hs.tmplRender.Assets = hs.assets
+	hs.tmplRender.Funcs(template.FuncMap{"T": hs.tmplFuncT})
+	hs.tmplRender.Funcs(hs.tmplFuncs)
+
+	assetsLocaleRoot, err := fs.Sub(hs.AssetsDir, "locale")
+	if err != nil {
+		fmlog.Fatalf("can not open locale directory for http server, err:%v", err)
+	}
+	if err = hs.i18n.LoadFS(assetsLocaleRoot); err != nil {
+		fmlog.Fatalf("can not load locale files for http server, err:%v", err)
+	}
+}
+
+func (hs *HttpServer) TemplateRender() *TemplateRender {
+	return hs.tmplRender
 }
 
 func (hs *HttpServer) TmplRender(w io.Writer, name string, data map[string]any) error {
@@ -147,10 +303,17 @@ func (hs *HttpServer) wrapHandlers(handlers ...AnyHandler) http.HandlerFunc {
 		ctx.wrappedContextType = reflect.TypeOf(ctx.WrappedContext)
 		contextWrap.value = ctx.WrappedContext
 
+		defer func() {
+			if ctx.Request.MultipartForm != nil {
+				_ = ctx.Request.MultipartForm.RemoveAll()
+			}
+		}()
 		defer func() {
 			if err := recover(); err != nil {
 				fmlog.Infof("fmhttp: panic request: %s %s, handler err: %v\n%s\n", r.Method, r.RequestURI, err, string(debug.Stack()))
-				http.Error(w, "internal error (handler panic)", http.StatusInternalServerError)
+				if !ctx.IsResponseWritten() {
+					_, _ = hs.respondError(ctx, w, 0, &HttpError{Status: http.StatusInternalServerError, Err: fmt.Errorf("handler panic: %v", err)})
+				}
 			}
 		}()
 
@@ -158,9 +321,7 @@ func (hs *HttpServer) wrapHandlers(handlers ...AnyHandler) http.HandlerFunc {
 
 		if ctx.session != nil {
 			err := ctx.session.AutoSave(w, r)
-			if err != nil && !strings.HasPrefix(err.Error(), "remove ") {
-				fmutil.MustNoError(err, "save session failed")
-			}
+			fmutil.MustNoError(err, "save session failed")
 		}
 
 		if resp != nil && resp != responseNop {
@@ -186,18 +347,35 @@ func (hs *HttpServer) HandleRequest(pattern string, handlers ...AnyHandler) {
 	hs.serverMux.Handle(pattern, hs.wrapHandlers(handlers...))
 }
 
+// HandleAssets serves the files in AssetsWebRoot by the request path, eg: "/assets/" serves "/assets/app.css" from "assets/app.css".
+// The files are served without the common middlewares (and the session, WrapContext), like ServeAssetFile in a router.
 func (hs *HttpServer) HandleAssets(pattern string) {
-	hs.serverMux.Handle(pattern, http.FileServer(http.FS(hs.AssetsWebRoot)))
+	hs.serverMux.Handle(pattern, hs.serveBare(hs.ServeAssetFile))
 }
 
-func (hs *HttpServer) ServeAssetFile(c *Context) Response {
-	path := c.Request.URL.Path[1:]
-	if f, err := hs.AssetsWebRoot.Open(path); err == nil {
-		return c.RespondFile(path, f)
+// serveBare responds by the handler without the common middlewares, the Context has no WrappedContext
+func (hs *HttpServer) serveBare(handle RequestHandlerFunc) http.HandlerFunc {
+	return func(wOrig http.ResponseWriter, r *http.Request) {
+		w := &ResponseWriterWrapper{responseWriter: wOrig}
+		resp := handle(&Context{HttpServer: hs, Request: r, ResponseWriter: w})
+		headers := w.Header()
+		for k, v := range resp.Header() {
+			headers[k] = v
+		}
+		if _, err := resp.RespondTo(w); err != nil {
+			fmlog.Infof("ERROR: failed to write response %T, err:%v", resp, err)
+		}
 	}
-	return c.Respond(404, "no static file: "+c.Request.RequestURI)
+}
+
+// ServeAssetFile serves the file in AssetsWebRoot by the request path
+func (hs *HttpServer) ServeAssetFile(c *Context) Response {
+	return hs.respondAsset(c, c.Request.URL.Path)
 }
 
 func (hs *HttpServer) ListenAndServe() error {
+	if hs.isTls() {
+		return hs.server.ListenAndServeTLS("", "")
+	}
 	return hs.server.ListenAndServe()
 }
@@ -0,0 +1,243 @@
+package fmhttp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"html/template"
+	"io/fs"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// TmplDataKeyError is the template data key of the *HttpError for the ErrorTemplate
+const TmplDataKeyError = "Error"
+
+const problemJsonContentType = "application/problem+json"
+
+// HttpError is an error with the HTTP status, it is responded as RFC 7807 "application/problem+json",
+// or rendered by the ErrorTemplate for browsers.
+type HttpError struct {
+	Status int
+	// Code is a machine-readable error code, eg: "user_not_found"
+	Code string
+	// Title is a short summary of the problem type, default is the status text
+	Title string
+	// Detail is the explanation for this occurrence, it is shown to the users
+	Detail string
+	// Extra fields are added to the problem object, eg: the invalid fields
+	Extra map[string]any
+
+	// Err is the cause, it is only logged and not shown to the users
+	Err error
+}
+
+func NewHttpError(status int, detail string) *HttpError {
+	return &HttpError{Status: status, Detail: detail}
+}
+
+func (e *HttpError) Error() string {
+	msg := fmutil.IfZero(e.Detail, e.title())
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *HttpError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HttpError) title() string {
+	return fmutil.IfZero(e.Title, http.StatusText(e.Status))
+}
+
+func (e *HttpError) WithCode(code string) *HttpError {
+	e.Code = code
+	return e
+}
+
+func (e *HttpError) WithTitle(title string) *HttpError {
+	e.Title = title
+	return e
+}
+
+func (e *HttpError) WithExtra(key string, value any) *HttpError {
+	if e.Extra == nil {
+		e.Extra = map[string]any{}
+	}
+	e.Extra[key] = value
+	return e
+}
+
+func (e *HttpError) Wrap(err error) *HttpError {
+	e.Err = err
+	return e
+}
+
+// ProblemJson returns the RFC 7807 problem object, the extra fields don't override the standard ones
+func (e *HttpError) ProblemJson(instance string) map[string]any {
+	problem := map[string]any{}
+	maps.Copy(problem, e.Extra)
+	problem["type"] = "about:blank"
+	problem["title"] = e.title()
+	problem["status"] = e.Status
+	if e.Detail != "" {
+		problem["detail"] = e.Detail
+	}
+	if e.Code != "" {
+		problem["code"] = e.Code
+	}
+	if instance != "" {
+		problem["instance"] = instance
+	}
+	return problem
+}
+
+type errorMapping struct {
+	target error
+	status int
+	code   string
+}
+
+// default mappings of the common errors, the later added mappings are checked first
+var defaultErrorMappings = []errorMapping{
+	{target: sql.ErrNoRows, status: http.StatusNotFound},
+	{target: fs.ErrNotExist, status: http.StatusNotFound},
+	{target: fs.ErrPermission, status: http.StatusForbidden},
+	{target: context.DeadlineExceeded, status: http.StatusGatewayTimeout},
+}
+
+// MapError makes the errors matching the target (by errors.Is) respond the status and code, eg: MapError(ErrUserBanned, 403, "banned")
+func (hs *HttpServer) MapError(target error, status int, code string) {
+	hs.errorMappings = append([]errorMapping{{target: target, status: status, code: code}}, hs.errorMappings...)
+}
+
+// MapErrorFunc adds a function to convert the domain errors, it returns nil if the error is not handled.
+// It is usually used with errors.As: var ve *ValidationError; if errors.As(err, &ve) { return NewHttpError(400, ve.Msg) }
+func (hs *HttpServer) MapErrorFunc(fn func(err error) *HttpError) {
+	hs.errorMapFuncs = append([]func(err error) *HttpError{fn}, hs.errorMapFuncs...)
+}
+
+// AsHttpError converts an error to *HttpError: the HttpError in the error chain, the mapped errors, or a 500 error.
+// The details of the unknown errors are only shown in DevMode.
+func (hs *HttpServer) AsHttpError(err error) *HttpError {
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	for _, fn := range hs.errorMapFuncs {
+		if httpErr = fn(err); httpErr != nil {
+			return httpErr
+		}
+	}
+	for _, m := range hs.errorMappings {
+		if errors.Is(err, m.target) {
+			return &HttpError{Status: m.status, Code: m.code, Err: err}
+		}
+	}
+	httpErr = &HttpError{Status: http.StatusInternalServerError, Err: err}
+	if hs.devMode {
+		httpErr.Detail = err.Error()
+	}
+	return httpErr
+}
+
+// acceptsHtml checks whether the client prefers HTML to JSON, eg: browsers
+func acceptsHtml(r *http.Request) bool {
+	for _, item := range parseAcceptHeader(strings.ToLower(r.Header.Get("Accept"))) {
+		if item.Q == 0 {
+			continue
+		}
+		switch item.Value {
+		case "text/html", "application/xhtml+xml":
+			return true
+		case "application/json", problemJsonContentType, "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// DefaultErrorHandler responds the error as "application/problem+json", or renders the ErrorTemplate if the client prefers HTML
+func DefaultErrorHandler(c *Context, err error) Response {
+	resp := defaultErrorResponse(c, err)
+	resp.Header().Add("Vary", "Accept")
+	return resp
+}
+
+func defaultErrorResponse(c *Context, err error) *ResponseCommon {
+	hs := c.HttpServer
+	httpErr := hs.AsHttpError(err)
+
+	if acceptsHtml(c.Request) {
+		errWithTitle := *httpErr
+		errWithTitle.Title = httpErr.title()
+		tmplData := map[string]any{TmplDataKeyStatusCode: httpErr.Status, TmplDataKeyError: &errWithTitle}
+		if hs.errorTemplate != "" && hs.tmplRender != nil {
+			return c.RespondTmpl(hs.errorTemplate, tmplData).SetStatusCode(httpErr.Status)
+		}
+		buf := &strings.Builder{}
+		if err = tmplDefaultErrorPage.Execute(buf, tmplData); err == nil {
+			resp := c.Respond(httpErr.Status, buf.String())
+			resp.Header().Set(headerContentType, "text/html; charset=utf-8")
+			return resp
+		}
+	}
+
+	buf, _ := json.Marshal(httpErr.ProblemJson(c.Request.URL.Path))
+	resp := c.Respond(httpErr.Status, buf)
+	resp.Header().Set(headerContentType, problemJsonContentType)
+	return resp
+}
+
+var tmplDefaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.StatusCode}} {{.Error.Title}}</title></head>
+<body>
+<h1>{{.StatusCode}} {{.Error.Title}}</h1>
+{{if .Error.Detail}}<p>{{.Error.Detail}}</p>{{end}}
+</body>
+</html>
+`))
+
+// respondError responds the error by the ErrorHandler, nothing has been written to the response yet.
+// The status code set by the handler is used if the error is not an HttpError, eg: c.Respond(400, err)
+func (hs *HttpServer) respondError(c *Context, w http.ResponseWriter, statusCode int, err error) (int64, error) {
+	var httpErr *HttpError
+	if statusCode != 0 && !errors.As(err, &httpErr) {
+		err = &HttpError{Status: statusCode, Err: err}
+	}
+	if httpErr = hs.AsHttpError(err); httpErr.Status >= http.StatusInternalServerError {
+		fmlog.Errorf("fmhttp: error response for %s %s, err: %v", c.Request.Method, c.Request.RequestURI, err)
+	}
+
+	// the ErrorHandler must not respond an error body, otherwise it is called again with a fallback handler
+	errorHandler := hs.ErrorHandler
+	switch c.errorDepth {
+	case 0:
+	case 1:
+		errorHandler = DefaultErrorHandler
+	default:
+		http.Error(w, http.StatusText(httpErr.Status), httpErr.Status)
+		return 0, err
+	}
+	c.errorDepth++
+	defer func() { c.errorDepth-- }()
+
+	resp := errorHandler(c, err)
+	headers := w.Header()
+	for k, v := range resp.Header() {
+		if k == "Vary" {
+			// keep the Vary of the middlewares, eg: Accept-Encoding
+			headers[k] = append(headers[k], v...)
+		} else {
+			headers[k] = v
+		}
+	}
+	return resp.RespondTo(w)
+}
@@ -0,0 +1,138 @@
+package fmhttp
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+type testValidationError struct {
+	Field string
+}
+
+func (e *testValidationError) Error() string {
+	return "invalid " + e.Field
+}
+
+func TestHttpErrorResponse(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	errBanned := errors.New("banned")
+	hs.MapError(errBanned, http.StatusForbidden, "banned")
+	hs.MapErrorFunc(func(err error) *HttpError {
+		var ve *testValidationError
+		if errors.As(err, &ve) {
+			return NewHttpError(http.StatusUnprocessableEntity, ve.Error()).WithExtra("field", ve.Field)
+		}
+		return nil
+	})
+
+	r := NewRouter()
+	r.Get("/user", func(c *Context) Response {
+		return c.Respond(fmt.Errorf("load user: %w", sql.ErrNoRows))
+	})
+	r.Get("/banned", func(c *Context) Response {
+		return c.Respond(fmt.Errorf("login: %w", errBanned))
+	})
+	r.Get("/validate", func(c *Context) Response {
+		return c.Respond(fmt.Errorf("save: %w", &testValidationError{Field: "name"}))
+	})
+	r.Get("/quota", func(c *Context) Response {
+		return c.Respond(NewHttpError(http.StatusTooManyRequests, "quota exceeded").WithCode("quota").WithExtra("limit", 10))
+	})
+	r.Get("/bad", func(c *Context) Response {
+		return c.Respond(http.StatusBadRequest, errors.New("bad input"))
+	})
+	r.Get("/internal", func(c *Context) Response {
+		return c.Respond(errors.New("db password is wrong"))
+	})
+	r.Get("/panic", func(c *Context) Response {
+		panic("boom")
+	})
+	handler := hs.wrapHandlers(r)
+
+	w := testServe(handler, "GET", "/user")
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"instance":"/user"}`, w.Body.String())
+
+	w = testServe(handler, "GET", "/banned")
+	assert.EqualValues(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Forbidden","status":403,"code":"banned","instance":"/banned"}`, w.Body.String())
+
+	w = testServe(handler, "GET", "/validate")
+	assert.EqualValues(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"invalid name","field":"name","instance":"/validate"}`, w.Body.String())
+
+	w = testServe(handler, "GET", "/quota")
+	assert.EqualValues(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Too Many Requests","status":429,"detail":"quota exceeded","code":"quota","limit":10,"instance":"/quota"}`, w.Body.String())
+
+	w = testServe(handler, "GET", "/bad")
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+
+	// the details of the unknown errors are hidden
+	w = testServe(handler, "GET", "/internal")
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "password")
+
+	w = testServe(handler, "GET", "/panic")
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"instance":"/panic"}`, w.Body.String())
+}
+
+func TestHttpErrorHandlerNested(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	hs.ErrorHandler = func(c *Context, err error) Response {
+		return c.Respond(fmt.Errorf("custom: %w", err))
+	}
+	r := NewRouter()
+	r.Use(Compress())
+	r.Get("/user", func(c *Context) Response {
+		return c.Respond(sql.ErrNoRows)
+	})
+	w := testServe(hs.wrapHandlers(r), "GET", "/user")
+
+	// the nested error is responded by DefaultErrorHandler
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, []string{"Accept-Encoding", "Accept"}, w.Header().Values("Vary"))
+}
+
+func TestHttpErrorHtml(t *testing.T) {
+	serve := func(hs *HttpServer, accept string) *httptest.ResponseRecorder {
+		handler := hs.wrapHandlers(func(c *Context) Response {
+			return c.Respond(NewHttpError(http.StatusNotFound, "no such <user>"))
+		})
+		return testServe(handler, "GET", "/", "Accept", accept)
+	}
+	browserAccept := "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	hs := testHttpServer(&Options{})
+	w := serve(hs, browserAccept)
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<h1>404 Not Found</h1>\n<p>no such &lt;user&gt;</p>")
+	assert.EqualValues(t, "application/problem+json", serve(hs, "application/json, text/html;q=0.9").Header().Get("Content-Type"))
+
+	hs = testHttpServer(&Options{
+		AssetsFS: fstest.MapFS{
+			"assets/template/error.tmpl": {Data: []byte(`{{.StatusCode}}:{{.Error.Title}}:{{.Error.Detail}}`)},
+		},
+		ErrorTemplate: "error.tmpl",
+	})
+	w = serve(hs, browserAccept)
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "404:Not Found:no such &lt;user&gt;", w.Body.String())
+
+	hs.ErrorHandler = func(c *Context, err error) Response {
+		return c.Respond(c.HttpServer.AsHttpError(err).Status, "custom")
+	}
+	w = serve(hs, browserAccept)
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "custom", w.Body.String())
+}
@@ -0,0 +1,345 @@
+package fmhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// SessionKeyLocale is the session value of the user's locale, it is set by Context.SetLocale
+	SessionKeyLocale = "__fm_locale"
+
+	// TmplDataKeyLocale is the template data key of the negotiated locale, it is set by RespondTmpl
+	TmplDataKeyLocale = "Locale"
+
+	// I18nArgCount is the argument which selects the plural form of a message, eg: T("items", "Count", 3)
+	I18nArgCount = "Count"
+
+	defaultLocale = "en"
+)
+
+// I18n holds the message catalogs of all locales.
+//
+// A message is a string with "{Name}" placeholders, or an object of plural forms (zero, one, two, few, many, other).
+// Nested objects are flattened into dotted keys: {"user": {"login": "Log in"}} defines "user.login".
+type I18n struct {
+	// DefaultLocale is the last fallback, and it is used when no requested locale is available
+	DefaultLocale string
+
+	// Fallbacks are the locales tried after a locale and its parents (eg: "zh-Hant-TW", "zh-Hant", "zh"),
+	// eg: {"pt-BR": {"pt-PT"}}. The DefaultLocale is always the last one.
+	Fallbacks map[string][]string
+
+	// the keys are the lower-case locales
+	messages    map[string]map[string]any
+	localeNames map[string]string
+}
+
+func NewI18n(defaultLocale string) *I18n {
+	return &I18n{
+		DefaultLocale: defaultLocale,
+		messages:      map[string]map[string]any{},
+		localeNames:   map[string]string{},
+	}
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// LoadFS loads the catalogs from "{locale}.json" or "{locale}.toml" files, or the files in "{locale}" directories.
+// It is not an error if the directory doesn't exist.
+func (i *I18n) LoadFS(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if err = i.loadFile(fsys, entry.Name(), ""); err != nil {
+				return err
+			}
+			continue
+		}
+		subEntries, err := fs.ReadDir(fsys, entry.Name())
+		if err != nil {
+			return err
+		}
+		for _, subEntry := range subEntries {
+			if !subEntry.IsDir() {
+				if err = i.loadFile(fsys, path.Join(entry.Name(), subEntry.Name()), entry.Name()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (i *I18n) loadFile(fsys fs.FS, name, locale string) error {
+	ext := path.Ext(name)
+	if ext != ".json" && ext != ".toml" {
+		return nil
+	}
+	if locale == "" {
+		locale = strings.TrimSuffix(path.Base(name), ext)
+	}
+	buf, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	messages := map[string]any{}
+	if ext == ".json" {
+		err = json.Unmarshal(buf, &messages)
+	} else {
+		err = toml.Unmarshal(buf, &messages)
+	}
+	if err != nil {
+		return fmt.Errorf("can not load locale file %s, err: %w", name, err)
+	}
+	i.AddMessages(locale, messages)
+	return nil
+}
+
+// AddMessages adds the messages to a locale, the existing messages with the same keys are replaced
+func (i *I18n) AddMessages(locale string, messages map[string]any) {
+	key := normalizeLocale(locale)
+	if i.messages[key] == nil {
+		i.messages[key] = map[string]any{}
+		i.localeNames[key] = strings.ReplaceAll(strings.TrimSpace(locale), "_", "-")
+	}
+	flattenMessages(i.messages[key], "", messages)
+}
+
+func isPluralForms(m map[string]any) bool {
+	for k, v := range m {
+		if _, ok := v.(string); !ok || !slices.Contains(pluralCategories, k) {
+			return false
+		}
+	}
+	return len(m) != 0
+}
+
+func flattenMessages(dst map[string]any, prefix string, messages map[string]any) {
+	for k, v := range messages {
+		switch v := v.(type) {
+		case string:
+			dst[prefix+k] = v
+		case map[string]any:
+			if isPluralForms(v) {
+				forms := map[string]string{}
+				for form, msg := range v {
+					forms[form] = msg.(string)
+				}
+				dst[prefix+k] = forms
+			} else {
+				flattenMessages(dst, prefix+k+".", v)
+			}
+		default:
+			dst[prefix+k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Locales returns the available locales
+func (i *I18n) Locales() []string {
+	locales := slices.Collect(maps.Values(i.localeNames))
+	slices.Sort(locales)
+	return locales
+}
+
+// parentLocales returns the locale and its parents: "zh-Hant-TW", "zh-Hant", "zh"
+func parentLocales(locale string) (ret []string) {
+	for locale != "" {
+		ret = append(ret, locale)
+		pos := strings.LastIndexByte(locale, '-')
+		if pos == -1 {
+			break
+		}
+		locale = locale[:pos]
+	}
+	return ret
+}
+
+// MatchLocale returns the available locale for a requested one, a more specific or a more general locale is also matched:
+// "en-US" matches "en", and "en" matches "en-GB" if there is no "en".
+func (i *I18n) MatchLocale(locale string) (string, bool) {
+	key := normalizeLocale(locale)
+	if key == "" {
+		return "", false
+	}
+	for _, parent := range parentLocales(key) {
+		if name, ok := i.localeNames[parent]; ok {
+			return name, true
+		}
+	}
+	base, _, _ := strings.Cut(key, "-")
+	for _, name := range i.Locales() {
+		if strings.HasPrefix(normalizeLocale(name), base+"-") {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// localeChain returns the lower-case locales to look up a message
+func (i *I18n) localeChain(locale string) (chain []string) {
+	add := func(locale string) {
+		for _, l := range parentLocales(normalizeLocale(locale)) {
+			if !slices.Contains(chain, l) {
+				chain = append(chain, l)
+			}
+		}
+	}
+	add(locale)
+	for k, fallbacks := range i.Fallbacks {
+		if normalizeLocale(k) == normalizeLocale(locale) {
+			for _, fallback := range fallbacks {
+				add(fallback)
+			}
+		}
+	}
+	add(i.DefaultLocale)
+	return chain
+}
+
+// i18nArgs accepts a map or key-value pairs: T("welcome", "Name", name) or T("welcome", map[string]any{"Name": name})
+func i18nArgs(args []any) map[string]any {
+	if len(args) == 1 {
+		switch v := args[0].(type) {
+		case map[string]any:
+			return v
+		case fmutil.Map:
+			return v
+		}
+	}
+	fmutil.MustTrue(len(args)%2 == 0, "i18n arguments must be key-value pairs")
+	ret := make(map[string]any, len(args)/2)
+	for idx := 0; idx < len(args); idx += 2 {
+		ret[fmutil.AsString(args[idx])] = args[idx+1]
+	}
+	return ret
+}
+
+// Translate returns the message of the key for the locale, the key itself is returned if the message doesn't exist
+func (i *I18n) Translate(locale, key string, args ...any) string {
+	argMap := i18nArgs(args)
+	for _, l := range i.localeChain(locale) {
+		switch msg := i.messages[l][key].(type) {
+		case string:
+			return formatMessage(msg, argMap)
+		case map[string]string:
+			count := fmutil.AsInt64(argMap[I18nArgCount])
+			form := pluralCategory(l, count)
+			if count == 0 && msg["zero"] != "" {
+				form = "zero"
+			}
+			return formatMessage(fmutil.IfZero(msg[form], msg["other"]), argMap)
+		}
+	}
+	return key
+}
+
+// formatMessage replaces the "{Name}" placeholders by the arguments, the unknown placeholders are kept
+func formatMessage(msg string, args map[string]any) string {
+	if len(args) == 0 || !strings.Contains(msg, "{") {
+		return msg
+	}
+	sb := strings.Builder{}
+	for {
+		start := strings.IndexByte(msg, '{')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(msg[start:], '}')
+		if end == -1 {
+			break
+		}
+		end += start
+		if v, ok := args[msg[start+1:end]]; ok {
+			sb.WriteString(msg[:start])
+			sb.WriteString(fmt.Sprint(v))
+		} else {
+			sb.WriteString(msg[:end+1])
+		}
+		msg = msg[end+1:]
+	}
+	sb.WriteString(msg)
+	return sb.String()
+}
+
+func (hs *HttpServer) I18n() *I18n {
+	return hs.i18n
+}
+
+// negotiateLocale uses the first available locale from: query parameter, cookie, session and Accept-Language.
+// The session is only read if the request has one, the anonymous requests don't create sessions.
+func (hs *HttpServer) negotiateLocale(c *Context) string {
+	if locale, ok := hs.i18n.MatchLocale(c.QueryParam(hs.localeQueryParam)); ok {
+		return locale
+	}
+	// the locale depends on the request headers, the shared caches must not serve it to the other users
+	h := c.ResponseWriter.Header()
+	for _, header := range []string{"Accept-Language", "Cookie"} {
+		if !slices.Contains(h.Values("Vary"), header) {
+			h.Add("Vary", header)
+		}
+	}
+	if cookie, err := c.Request.Cookie(hs.localeCookieName); err == nil {
+		if locale, ok := hs.i18n.MatchLocale(cookie.Value); ok {
+			return locale
+		}
+	}
+	if c.hasSession() {
+		if locale, ok := hs.i18n.MatchLocale(c.Session().GetString(SessionKeyLocale)); ok {
+			return locale
+		}
+	}
+	for _, item := range parseAcceptHeader(c.Request.Header.Get("Accept-Language")) {
+		if item.Q == 0 || item.Value == "*" {
+			continue
+		}
+		if locale, ok := hs.i18n.MatchLocale(item.Value); ok {
+			return locale
+		}
+	}
+	return hs.i18n.DefaultLocale
+}
+
+// Locale returns the negotiated locale of the request
+func (c *Context) Locale() string {
+	if c.locale == "" {
+		c.locale = c.HttpServer.negotiateLocale(c)
+	}
+	return c.locale
+}
+
+// SetLocale changes the locale of the request, and saves it into the session if the session is enabled
+func (c *Context) SetLocale(locale string) {
+	c.locale = locale
+	if c.HttpServer.sessionStore != nil {
+		c.Session().Set(SessionKeyLocale, locale)
+	}
+}
+
+// T translates the message for the request's locale, eg: c.T("cart.items", "Count", 3)
+func (c *Context) T(key string, args ...any) string {
+	return c.HttpServer.i18n.Translate(c.Locale(), key, args...)
+}
+
+// tmplFuncT translates the message by the template data's locale: {{T . "cart.items" "Count" .Count}}
+// (or `$` instead of `.` inside range/with).
+func (hs *HttpServer) tmplFuncT(data map[string]any, key string, args ...any) string {
+	return hs.i18n.Translate(fmutil.AsString(data[TmplDataKeyLocale], hs.i18n.DefaultLocale), key, args...)
+}
@@ -0,0 +1,67 @@
+package fmhttp
+
+import "strings"
+
+var pluralCategories = []string{"zero", "one", "two", "few", "many", "other"}
+
+// pluralCategory returns the CLDR plural category of an integer for the language of the locale.
+// Only the rules of the common languages are built in, the others use the English rule.
+func pluralCategory(locale string, n int64) string {
+	lang, _, _ := strings.Cut(normalizeLocale(locale), "-")
+	if n < 0 {
+		n = -n
+	}
+	mod10, mod100 := n%10, n%100
+	switch lang {
+	case "ja", "ko", "zh", "th", "vi", "id", "ms", "lo", "my", "km":
+		return "other"
+	case "fr", "hi", "bn", "fa", "am", "zu":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+	case "ru", "uk", "be":
+		if mod10 == 1 && mod100 != 11 {
+			return "one"
+		} else if mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14) {
+			return "few"
+		}
+		return "many"
+	case "sr", "hr", "bs":
+		if mod10 == 1 && mod100 != 11 {
+			return "one"
+		} else if mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14) {
+			return "few"
+		}
+	case "pl":
+		if n == 1 {
+			return "one"
+		} else if mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14) {
+			return "few"
+		}
+		return "many"
+	case "cs", "sk":
+		if n == 1 {
+			return "one"
+		} else if n >= 2 && n <= 4 {
+			return "few"
+		}
+	case "ar":
+		switch {
+		case n == 0:
+			return "zero"
+		case n == 1:
+			return "one"
+		case n == 2:
+			return "two"
+		case mod100 >= 3 && mod100 <= 10:
+			return "few"
+		case mod100 >= 11:
+			return "many"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,103 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestI18nTranslate(t *testing.T) {
+	i := NewI18n("en")
+	err := i.LoadFS(fstest.MapFS{
+		"en.json":               {Data: []byte(`{"hello": "Hello {Name}", "cart": {"items": {"zero": "No items", "one": "{Count} item", "other": "{Count} items"}}, "only-en": "en"}`)},
+		"ru.toml":               {Data: []byte("hello = \"Привет {Name}\"\n[cart.items]\none = \"{Count} товар\"\nfew = \"{Count} товара\"\nmany = \"{Count} товаров\"\n")},
+		"zh-Hant/messages.json": {Data: []byte(`{"hello": "你好 {Name}"}`)},
+		"pt-PT.json":            {Data: []byte(`{"hello": "Olá {Name}"}`)},
+		"README.md":             {Data: []byte(`ignored`)},
+	})
+	assert.NoError(t, err)
+	i.Fallbacks = map[string][]string{"pt-BR": {"pt-PT"}}
+	assert.EqualValues(t, []string{"en", "pt-PT", "ru", "zh-Hant"}, i.Locales())
+
+	assert.EqualValues(t, "Hello a", i.Translate("en", "hello", "Name", "a"))
+	assert.EqualValues(t, "Hello {Name}", i.Translate("en", "hello"))
+	assert.EqualValues(t, "Привет a", i.Translate("ru", "hello", map[string]any{"Name": "a"}))
+	assert.EqualValues(t, "你好 a", i.Translate("zh-Hant-TW", "hello", "Name", "a"))
+	assert.EqualValues(t, "Olá a", i.Translate("pt-BR", "hello", "Name", "a"))
+	assert.EqualValues(t, "en", i.Translate("ru", "only-en"))
+	assert.EqualValues(t, "no-such-key", i.Translate("ru", "no-such-key"))
+
+	assert.EqualValues(t, "No items", i.Translate("en", "cart.items", "Count", 0))
+	assert.EqualValues(t, "1 item", i.Translate("en", "cart.items", "Count", 1))
+	assert.EqualValues(t, "5 items", i.Translate("en", "cart.items", "Count", 5))
+	assert.EqualValues(t, "21 товар", i.Translate("ru", "cart.items", "Count", 21))
+	assert.EqualValues(t, "3 товара", i.Translate("ru", "cart.items", "Count", 3))
+	assert.EqualValues(t, "11 товаров", i.Translate("ru", "cart.items", "Count", 11))
+
+	assert.EqualValues(t, "one", pluralCategory("hr", 21))
+	assert.EqualValues(t, "few", pluralCategory("sr-Latn", 3))
+	assert.EqualValues(t, "other", pluralCategory("bs", 11))
+	assert.EqualValues(t, "other", pluralCategory("hr", 5))
+	assert.EqualValues(t, "many", pluralCategory("uk", 5))
+
+	locale, ok := i.MatchLocale("en_US")
+	assert.True(t, ok)
+	assert.EqualValues(t, "en", locale)
+	locale, _ = i.MatchLocale("pt")
+	assert.EqualValues(t, "pt-PT", locale)
+	_, ok = i.MatchLocale("de")
+	assert.False(t, ok)
+}
+
+func TestContextLocale(t *testing.T) {
+	hs := testHttpServer(&Options{
+		AssetsFS: fstest.MapFS{
+			"assets/locale/en.json":      {Data: []byte(`{"hello": "Hello {Name}"}`)},
+			"assets/locale/fr.json":      {Data: []byte(`{"hello": "Bonjour {Name}"}`)},
+			"assets/locale/de.json":      {Data: []byte(`{"hello": "Hallo {Name}"}`)},
+			"assets/template/hello.tmpl": {Data: []byte(`{{.Locale}}:{{T . "hello" "Name" .Name}}`)},
+		},
+		SessionCookieName:      "test-session",
+		SessionCookieSecureKey: "test-hash-key",
+		SessionStoreType:       SessionStoreMemory,
+	})
+	r := NewRouter()
+	r.Get("/hello", func(c *Context) Response {
+		return c.RespondTmpl("hello.tmpl", map[string]any{"Name": "<a>"})
+	})
+	r.Get("/set", func(c *Context) Response {
+		c.SetLocale("de")
+		return c.Respond(200, c.T("hello", "Name", "b"))
+	})
+	handler := hs.wrapHandlers(r)
+
+	req := httptest.NewRequest("GET", "/hello", nil)
+	w := testServeRequest(handler, req)
+	assert.EqualValues(t, "en:Hello &lt;a&gt;", w.Body.String())
+	assert.EqualValues(t, []string{"Accept-Language", "Cookie"}, w.Header().Values("Vary"))
+	// no session is created for reading the locale
+	assert.Empty(t, w.Result().Cookies())
+
+	req.Header.Set("Accept-Language", "ja, fr-CA;q=0.8, en;q=0.5")
+	assert.EqualValues(t, "fr:Bonjour &lt;a&gt;", testServeRequest(handler, req).Body.String())
+
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "de"})
+	assert.EqualValues(t, "de:Hallo &lt;a&gt;", testServeRequest(handler, req).Body.String())
+
+	req = httptest.NewRequest("GET", "/hello?lang=en", nil)
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "de"})
+	w = testServeRequest(handler, req)
+	assert.EqualValues(t, "en:Hello &lt;a&gt;", w.Body.String())
+	assert.Empty(t, w.Header().Values("Vary"))
+
+	w = testServeRequest(handler, httptest.NewRequest("GET", "/set", nil))
+	assert.EqualValues(t, "Hallo b", w.Body.String())
+	req = httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Set("Accept-Language", "fr")
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	assert.EqualValues(t, "de:Hallo &lt;a&gt;", testServeRequest(handler, req).Body.String())
+}
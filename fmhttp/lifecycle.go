@@ -0,0 +1,104 @@
+package fmhttp
+
+import (
+	"context"
+	"errors"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// LifecycleHook is called when the server starts (before accepting connections) or stops (after draining requests)
+type LifecycleHook func(ctx context.Context) error
+
+func (hs *HttpServer) OnStart(hooks ...LifecycleHook) {
+	hs.onStartHooks = append(hs.onStartHooks, hooks...)
+}
+
+func (hs *HttpServer) OnStop(hooks ...LifecycleHook) {
+	hs.onStopHooks = append(hs.onStopHooks, hooks...)
+}
+
+// Run listens and serves until the ctx is done or SIGINT/SIGTERM is received,
+// then it drains in-flight requests within the shutdown timeout and calls the OnStop hooks.
+func (hs *HttpServer) Run(ctx context.Context) error {
+	ctx, stopSignal := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignal()
+
+	sls, err := hs.listenAll()
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hs.onStartHooks {
+		if err = hook(ctx); err != nil {
+			for _, sl := range sls {
+				_ = sl.ln.Close()
+			}
+			return err
+		}
+	}
+
+	serveErr := make(chan error, len(sls))
+	for _, sl := range sls {
+		go func(sl serverListener) {
+			serveErr <- hs.serve(sl)
+		}(sl)
+		fmlog.Infof("fmhttp: listening on %s %s", sl.ln.Addr().Network(), sl.ln.Addr())
+	}
+
+	// if any listener fails, the whole server is shut down
+	serving := len(sls)
+	select {
+	case err = <-serveErr:
+		serving--
+	case <-ctx.Done():
+	}
+	err = errors.Join(ignoreServerClosed(err), hs.Shutdown(context.Background()))
+	for ; serving > 0; serving-- {
+		err = errors.Join(err, ignoreServerClosed(<-serveErr))
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), hs.shutdownTimeout)
+	defer cancel()
+	for _, hook := range hs.onStopHooks {
+		err = errors.Join(err, hook(stopCtx))
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests within the shutdown timeout,
+// the remaining connections are closed forcibly when the timeout is reached.
+func (hs *HttpServer) Shutdown(ctx context.Context) error {
+	fmlog.Infof("fmhttp: shutting down, waiting at most %v for in-flight requests", hs.shutdownTimeout)
+	ctx, cancel := context.WithTimeout(ctx, hs.shutdownTimeout)
+	defer cancel()
+
+	hs.listenersMu.Lock()
+	servers := fmutil.Iif(len(hs.servers) == 0, []*http.Server{hs.server}, hs.servers)
+	hs.listenersMu.Unlock()
+
+	var errs error
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmlog.Warnf("fmhttp: shutdown timeout, closing remaining connections")
+			err = server.Close()
+		}
+		errs = errors.Join(errs, err)
+	}
+	return errs
+}
+
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
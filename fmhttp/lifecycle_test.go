@@ -0,0 +1,156 @@
+package fmhttp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testHttpServer(opt *Options) *HttpServer {
+	if opt.AssetsFS == nil {
+		opt.AssetsFS = fstest.MapFS{}
+	}
+	hs := NewHttpServer(opt)
+	hs.WrapContext = func(c *Context) AnyContext { return c }
+	return hs
+}
+
+func TestHttpServerRun(t *testing.T) {
+	hs := testHttpServer(&Options{Listen: "127.0.0.1:0", ShutdownTimeout: time.Second})
+
+	requestStarted := make(chan struct{})
+	requestDone := make(chan struct{})
+	hs.HandleRequest("/slow", func(c *Context) Response {
+		close(requestStarted)
+		time.Sleep(100 * time.Millisecond)
+		return c.Respond(200, "done")
+	})
+
+	var events []string
+	hs.OnStart(func(ctx context.Context) error {
+		events = append(events, "start")
+		return nil
+	})
+	hs.OnStop(func(ctx context.Context) error {
+		events = append(events, "stop")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool { return len(hs.ListenAddrs()) == 1 }, time.Second, 10*time.Millisecond)
+	addr := hs.ListenAddrs()[0].String()
+
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 200, resp.StatusCode)
+			_ = resp.Body.Close()
+		}
+		close(requestDone)
+	}()
+	<-requestStarted
+	cancel()
+
+	assert.NoError(t, <-runErr)
+	<-requestDone
+	assert.EqualValues(t, []string{"start", "stop"}, events)
+}
+
+func TestHttpServerRunListeners(t *testing.T) {
+	adminRouter := NewRouter()
+	adminRouter.Get("/status", func(c *Context) Response {
+		return c.Respond(200, "admin")
+	})
+	sockPath := filepath.Join(t.TempDir(), "fmhttp.sock")
+	hs := testHttpServer(&Options{Listeners: []ListenOptions{
+		{Addr: "127.0.0.1:0"},
+		{Addr: "unix:" + sockPath, Router: adminRouter, UnixSocketMode: 0o600},
+	}})
+	hs.HandleRequest("/status", func(c *Context) Response {
+		return c.Respond(200, "public")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool { return len(hs.ListenAddrs()) == 2 }, time.Second, 10*time.Millisecond)
+
+	st, err := os.Stat(sockPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0o600, st.Mode().Perm())
+
+	get := func(client *http.Client, url string) string {
+		resp, err := client.Get(url)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+		},
+	}}
+	assert.EqualValues(t, "public", get(http.DefaultClient, "http://"+hs.ListenAddrs()[0].String()+"/status"))
+	assert.EqualValues(t, "admin", get(unixClient, "http://unix/status"))
+
+	cancel()
+	assert.NoError(t, <-runErr)
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHttpServerRunRestart(t *testing.T) {
+	hs := testHttpServer(&Options{Listen: "127.0.0.1:0", ShutdownTimeout: time.Second})
+	hs.HandleRequest("/status", func(c *Context) Response {
+		return c.Respond(200, "ok")
+	})
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- hs.Run(ctx)
+		}()
+		// the listeners of the previous run are not kept
+		assert.Eventually(t, func() bool {
+			hs.listenersMu.Lock()
+			defer hs.listenersMu.Unlock()
+			return len(hs.listeners) == 1 && len(hs.servers) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		resp, err := http.Get("http://" + hs.ListenAddrs()[0].String() + "/status")
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 200, resp.StatusCode)
+			_ = resp.Body.Close()
+		}
+		cancel()
+		assert.NoError(t, <-runErr)
+	}
+}
+
+func TestListenSystemdEnv(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	_, err := listen(ListenOptions{Addr: "systemd:0"})
+	assert.Error(t, err)
+	// the variables are consumed once, the child processes don't inherit them
+	_, found := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, found)
+}
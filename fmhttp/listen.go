@@ -0,0 +1,197 @@
+package fmhttp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	listenPrefixUnix    = "unix:"
+	listenPrefixSystemd = "systemd:"
+)
+
+type ListenOptions struct {
+	// Addr is "host:port" for TCP, "unix:/path/to.sock" for a Unix domain socket,
+	// or "systemd:N" / "systemd:name" for the N-th (or the named) file descriptor passed by systemd socket activation
+	Addr string
+
+	// Router serves the requests from this listener, the server's common middlewares are applied.
+	// If it is nil, the requests are served by the handlers registered on the HttpServer.
+	Router Router
+
+	// UnixSocketMode is the permission of the Unix domain socket file, default is 0660
+	UnixSocketMode fs.FileMode
+}
+
+type serverListener struct {
+	server *http.Server
+	ln     net.Listener
+}
+
+func (hs *HttpServer) listenOptions() []ListenOptions {
+	if len(hs.listenOpts) != 0 {
+		return hs.listenOpts
+	}
+	return []ListenOptions{{Addr: fmutil.IfZero(hs.server.Addr, fmutil.Iif(hs.isTls(), ":https", ":http"))}}
+}
+
+func (hs *HttpServer) newServerFor(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		TLSConfig:         hs.server.TLSConfig,
+		TLSNextProto:      hs.server.TLSNextProto,
+		ReadTimeout:       hs.server.ReadTimeout,
+		ReadHeaderTimeout: hs.server.ReadHeaderTimeout,
+		WriteTimeout:      hs.server.WriteTimeout,
+		IdleTimeout:       hs.server.IdleTimeout,
+		MaxHeaderBytes:    hs.server.MaxHeaderBytes,
+	}
+}
+
+// listenAll opens all listeners, if one of them fails, the opened ones are closed.
+// The servers are created for every run, because a shut down http.Server can't be reused.
+func (hs *HttpServer) listenAll() (sls []serverListener, err error) {
+	var defaultServer *http.Server
+	for _, opt := range hs.listenOptions() {
+		var ln net.Listener
+		ln, err = listen(opt)
+		if err != nil {
+			for _, sl := range sls {
+				_ = sl.ln.Close()
+			}
+			return nil, fmt.Errorf("fmhttp: can not listen on %s, err: %w", opt.Addr, err)
+		}
+		var server *http.Server
+		if opt.Router != nil {
+			server = hs.newServerFor(hs.wrapHandlers(opt.Router))
+		} else {
+			if defaultServer == nil {
+				defaultServer = hs.newServerFor(hs.server.Handler)
+			}
+			server = defaultServer
+		}
+		sls = append(sls, serverListener{server: server, ln: ln})
+	}
+
+	hs.listenersMu.Lock()
+	defer hs.listenersMu.Unlock()
+	hs.listeners, hs.servers = nil, nil
+	for _, sl := range sls {
+		hs.listeners = append(hs.listeners, sl.ln)
+		if !slices.Contains(hs.servers, sl.server) {
+			hs.servers = append(hs.servers, sl.server)
+		}
+	}
+	return sls, nil
+}
+
+// ListenAddrs returns the addresses the server is listening on, it is useful when listening on a random port
+func (hs *HttpServer) ListenAddrs() (addrs []net.Addr) {
+	hs.listenersMu.Lock()
+	defer hs.listenersMu.Unlock()
+	for _, ln := range hs.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+func (hs *HttpServer) serve(sl serverListener) error {
+	if hs.isTls() {
+		return sl.server.ServeTLS(sl.ln, "", "")
+	}
+	return sl.server.Serve(sl.ln)
+}
+
+func listen(opt ListenOptions) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(opt.Addr, listenPrefixUnix):
+		return listenUnix(opt.Addr[len(listenPrefixUnix):], fmutil.IfZero(opt.UnixSocketMode, 0o660))
+	case strings.HasPrefix(opt.Addr, listenPrefixSystemd):
+		return listenSystemd(opt.Addr[len(listenPrefixSystemd):])
+	default:
+		return net.Listen("tcp", opt.Addr)
+	}
+}
+
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	// remove the stale socket file left by a previous process, but never remove a regular file
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+const systemdListenFdsStart = 3
+
+// systemdFds are the file descriptors passed by systemd, they are consumed once and kept open,
+// so the server could listen on them again after a restart
+var systemdFds struct {
+	once  sync.Once
+	files []*os.File
+	names []string
+	err   error
+}
+
+// systemdListenFiles reads the file descriptors from the environment variables (see sd_listen_fds(3)),
+// the variables are unset so the child processes don't inherit them
+func systemdListenFiles() ([]*os.File, []string, error) {
+	systemdFds.once.Do(func() {
+		defer func() {
+			_ = os.Unsetenv("LISTEN_PID")
+			_ = os.Unsetenv("LISTEN_FDS")
+			_ = os.Unsetenv("LISTEN_FDNAMES")
+		}()
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			systemdFds.err = errors.New("no file descriptor is passed by systemd for this process")
+			return
+		}
+		fdCount, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			systemdFds.err = fmt.Errorf("invalid LISTEN_FDS, err: %w", err)
+			return
+		}
+		systemdFds.names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < fdCount; i++ {
+			systemdFds.files = append(systemdFds.files, os.NewFile(uintptr(systemdListenFdsStart+i), "systemd:"+strconv.Itoa(i)))
+		}
+	})
+	return systemdFds.files, systemdFds.names, systemdFds.err
+}
+
+// listenSystemd uses the file descriptor passed by systemd, the listener has a duplicated descriptor
+func listenSystemd(fdName string) (net.Listener, error) {
+	files, names, err := systemdListenFiles()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := strconv.Atoi(fdName)
+	if err != nil {
+		idx = slices.Index(names, fdName)
+	}
+	if idx < 0 || idx >= len(files) {
+		return nil, fmt.Errorf("no file descriptor %q in LISTEN_FDS=%d", fdName, len(files))
+	}
+	return net.FileListener(files[idx])
+}
@@ -0,0 +1,367 @@
+package fmhttp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const (
+	FormatJson = "json"
+	FormatHtml = "html"
+	FormatXml  = "xml"
+	FormatText = "text"
+	FormatCsv  = "csv"
+
+	// TmplDataKeyData is the template data key of the negotiated data if it is not a map
+	TmplDataKeyData = "Data"
+)
+
+var negotiateFormatMediaTypes = map[string][]string{
+	FormatJson: {"application/json"},
+	FormatHtml: {"text/html", "application/xhtml+xml"},
+	FormatXml:  {"application/xml", "text/xml"},
+	FormatText: {"text/plain"},
+	FormatCsv:  {"text/csv"},
+}
+
+var negotiateFormatExtensions = map[string]string{
+	".json": FormatJson,
+	".html": FormatHtml,
+	".xml":  FormatXml,
+	".txt":  FormatText,
+	".csv":  FormatCsv,
+}
+
+type NegotiateOptions struct {
+	// Formats are the offered formats in the preferred order, default is json, html, xml, text and csv.
+	// The html format is only offered if Template is set, the csv format is only offered if the data is a slice.
+	Formats []string
+
+	// Template renders the html format, the data is passed directly if it is a map, otherwise it is passed as "Data"
+	Template string
+
+	// FormatQueryParam overrides the Accept header, default is "format", eg: "/users?format=csv".
+	// The extension of the request path also overrides it, eg: "/users.csv".
+	FormatQueryParam string
+
+	StatusCode int
+}
+
+var negotiateDefaultFormats = []string{FormatJson, FormatHtml, FormatXml, FormatText, FormatCsv}
+
+func (opt *NegotiateOptions) offeredFormats(data any) (formats []string) {
+	for _, format := range fmutil.IfZero(opt.Formats, negotiateDefaultFormats) {
+		if format == FormatHtml && opt.Template == "" {
+			continue
+		}
+		if format == FormatCsv && !isCsvData(data) {
+			continue
+		}
+		if _, ok := negotiateFormatMediaTypes[format]; ok {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// negotiateFormat returns the offered format by the override or the Accept header, it is empty if nothing matches
+func negotiateFormat(c *Context, opt *NegotiateOptions, offered []string) string {
+	override := c.QueryParam(fmutil.IfZero(opt.FormatQueryParam, "format"))
+	if override == "" {
+		override = negotiateFormatExtensions[strings.ToLower(path.Ext(c.Request.URL.Path))]
+	}
+	if override != "" {
+		return fmutil.Iif(slices.Contains(offered, override), override, "")
+	}
+
+	accept := c.Request.Header.Get("Accept")
+	if accept == "" {
+		return offered[0]
+	}
+	items := parseAcceptHeader(strings.ToLower(accept))
+	rejected := func(mediaType string) bool {
+		for _, item := range items {
+			if item.Q == 0 && item.Value == mediaType {
+				return true
+			}
+		}
+		return false
+	}
+	for _, item := range items {
+		if item.Q == 0 {
+			continue
+		}
+		for _, format := range offered {
+			for _, mediaType := range negotiateFormatMediaTypes[format] {
+				mainType, _, _ := strings.Cut(mediaType, "/")
+				if item.Value == mediaType || ((item.Value == "*/*" || item.Value == mainType+"/*") && !rejected(mediaType)) {
+					return format
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// RespondNegotiated responds the data in the format requested by the Accept header (or the "format" query parameter).
+// It responds 406 if no offered format is acceptable.
+func (c *Context) RespondNegotiated(data any, opts ...NegotiateOptions) *ResponseCommon {
+	opt := fmutil.DefZero(opts)
+	offered := opt.offeredFormats(data)
+	fmutil.MustTrue(len(offered) != 0, "no format is offered for the negotiated response")
+
+	var resp *ResponseCommon
+	switch format := negotiateFormat(c, &opt, offered); format {
+	case FormatJson:
+		resp = c.RespondJson(data)
+	case FormatHtml:
+		tmplData, ok := data.(map[string]any)
+		if !ok {
+			tmplData = map[string]any{TmplDataKeyData: data}
+		}
+		resp = c.RespondTmpl(opt.Template, tmplData)
+	case FormatXml, FormatText, FormatCsv:
+		buf, err := encodeNegotiated(format, data)
+		if err != nil {
+			resp = c.Respond(err)
+		} else {
+			resp = c.Respond(buf)
+			resp.Header().Set(headerContentType, negotiateFormatMediaTypes[format][0]+"; charset=utf-8")
+		}
+	default:
+		var mediaTypes []string
+		for _, f := range offered {
+			mediaTypes = append(mediaTypes, negotiateFormatMediaTypes[f]...)
+		}
+		resp = c.Respond(http.StatusNotAcceptable, "not acceptable, available: "+strings.Join(mediaTypes, ", "))
+		resp.Header().Set(headerContentType, "text/plain; charset=utf-8")
+		resp.Vary("Accept")
+		return resp
+	}
+	if opt.StatusCode != 0 {
+		resp.SetStatusCode(opt.StatusCode)
+	}
+	resp.Vary("Accept")
+	return resp
+}
+
+func encodeNegotiated(format string, data any) ([]byte, error) {
+	switch format {
+	case FormatXml:
+		buf := &bytes.Buffer{}
+		buf.WriteString(xml.Header)
+		err := xml.NewEncoder(buf).Encode(asXmlValue(data, "response"))
+		return buf.Bytes(), err
+	case FormatText:
+		switch v := data.(type) {
+		case string:
+			return []byte(v), nil
+		case []byte:
+			return v, nil
+		case fmt.Stringer:
+			return []byte(v.String()), nil
+		}
+		return []byte(fmt.Sprint(data)), nil
+	case FormatCsv:
+		return encodeCsv(data)
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// xmlMap encodes a map as elements sorted by the keys, encoding/xml doesn't support maps
+type xmlMap struct {
+	name string
+	m    map[string]any
+}
+
+func (x xmlMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if x.name != "" {
+		start = xml.StartElement{Name: xml.Name{Local: x.name}}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(x.m))
+	for k := range x.m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if err := e.EncodeElement(asXmlValue(x.m[k], ""), xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// xmlSlice encodes the items of a slice as "item" elements
+type xmlSlice struct {
+	name  string
+	items []any
+}
+
+func (x xmlSlice) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if x.name != "" {
+		start = xml.StartElement{Name: xml.Name{Local: x.name}}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, item := range x.items {
+		if err := e.EncodeElement(asXmlValue(item, ""), xml.StartElement{Name: xml.Name{Local: "item"}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// asXmlValue wraps the string-keyed maps and the slices (except []byte), so a slice is encoded as one root element.
+// The name is the element name of the root value, the nested values use their keys.
+func asXmlValue(data any, name string) any {
+	rv := reflect.ValueOf(data)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			m := make(map[string]any, rv.Len())
+			for iter := rv.MapRange(); iter.Next(); {
+				m[iter.Key().String()] = iter.Value().Interface()
+			}
+			return xmlMap{name: name, m: m}
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			items := make([]any, rv.Len())
+			for i := range items {
+				items[i] = rv.Index(i).Interface()
+			}
+			return xmlSlice{name: name, items: items}
+		}
+	}
+	return data
+}
+
+// isCsvData reports whether the data is a slice of rows (structs, maps or slices),
+// the elements of []any are checked one by one and must be the same type
+func isCsvData(data any) bool {
+	rv := reflect.ValueOf(data)
+	if !rv.IsValid() || rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return false
+	}
+	if rv.Type().Elem().Kind() != reflect.Interface {
+		return isCsvRowType(rv.Type().Elem())
+	}
+	var rowType reflect.Type
+	for i := 0; i < rv.Len(); i++ {
+		item := rv.Index(i).Elem()
+		if !item.IsValid() || !isCsvRowType(item.Type()) {
+			return false
+		}
+		if t := csvRowType(item.Type()); rowType == nil {
+			rowType = t
+		} else if t != rowType {
+			return false
+		}
+	}
+	return true
+}
+
+// csvRowType is the type of the row without pointers, eg: *T and T are the same row type
+func csvRowType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func isCsvRowType(t reflect.Type) bool {
+	kind := csvRowType(t).Kind()
+	return kind == reflect.Struct || kind == reflect.Map || kind == reflect.Slice || kind == reflect.Array
+}
+
+// encodeCsv encodes [][]string directly, the slices of maps or structs have a header row:
+// the sorted keys of the first map, or the struct fields (the "csv" tag is used as the name, "-" skips the field).
+// All rows must be the same type.
+func encodeCsv(data any) ([]byte, error) {
+	var rows [][]string
+	if v, ok := data.([][]string); ok {
+		rows = v
+	} else {
+		rv := reflect.ValueOf(data)
+		var rowType reflect.Type
+		var header []string
+		var mapKeys []reflect.Value
+		var fieldIndexes []int
+		for i := 0; i < rv.Len(); i++ {
+			item := reflect.Indirect(rv.Index(i))
+			if item.Kind() == reflect.Interface {
+				item = reflect.Indirect(item.Elem())
+			}
+			if !item.IsValid() {
+				return nil, fmt.Errorf("can not encode nil as csv row")
+			} else if i == 0 {
+				rowType = item.Type()
+			} else if item.Type() != rowType {
+				return nil, fmt.Errorf("can not encode csv rows of different types: %s and %s", rowType, item.Type())
+			}
+			switch item.Kind() {
+			case reflect.Map:
+				if i == 0 {
+					// the keys are sorted by their string forms, and the values are looked up by the original keys
+					mapKeys = item.MapKeys()
+					slices.SortFunc(mapKeys, func(a, b reflect.Value) int {
+						return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+					})
+					for _, k := range mapKeys {
+						header = append(header, fmt.Sprint(k.Interface()))
+					}
+					rows = append(rows, header)
+				}
+				row := make([]string, len(mapKeys))
+				for j, k := range mapKeys {
+					if v := item.MapIndex(k); v.IsValid() {
+						row[j] = fmt.Sprint(v.Interface())
+					}
+				}
+				rows = append(rows, row)
+			case reflect.Struct:
+				if i == 0 {
+					for j := 0; j < item.NumField(); j++ {
+						field := item.Type().Field(j)
+						name := fmutil.IfZero(field.Tag.Get("csv"), field.Name)
+						if !field.IsExported() || name == "-" {
+							continue
+						}
+						header = append(header, name)
+						fieldIndexes = append(fieldIndexes, j)
+					}
+					rows = append(rows, header)
+				}
+				row := make([]string, len(fieldIndexes))
+				for j, fieldIndex := range fieldIndexes {
+					row[j] = fmt.Sprint(item.Field(fieldIndex).Interface())
+				}
+				rows = append(rows, row)
+			case reflect.Slice, reflect.Array:
+				row := make([]string, item.Len())
+				for j := range row {
+					row[j] = fmt.Sprint(item.Index(j).Interface())
+				}
+				rows = append(rows, row)
+			default:
+				return nil, fmt.Errorf("can not encode %s as csv row", rv.Index(i).Type())
+			}
+		}
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	err := w.WriteAll(rows)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,102 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRespondNegotiated(t *testing.T) {
+	hs := testHttpServer(&Options{AssetsFS: fstest.MapFS{
+		"assets/template/users.tmpl": {Data: []byte(`{{range .Data}}<p>{{.Name}}</p>{{end}}`)},
+	}})
+	type user struct {
+		Name  string `csv:"name"`
+		Age   int
+		Email string `csv:"-"`
+	}
+	users := []user{{Name: "a", Age: 1, Email: "a@x"}, {Name: "b", Age: 2}}
+	handler := hs.wrapHandlers(func(c *Context) Response {
+		switch c.QueryParam("data") {
+		case "map":
+			return c.RespondNegotiated(map[string]any{"Name": "a", "Tags": []any{"x", "y"}}, NegotiateOptions{Formats: []string{FormatXml, FormatText}})
+		case "strings":
+			return c.RespondNegotiated(map[string]string{"b": "2", "a": "1"})
+		case "int-keys":
+			return c.RespondNegotiated([]map[int]string{{2: "b", 10: "j"}, {2: "c"}})
+		}
+		return c.RespondNegotiated(users, NegotiateOptions{Template: "users.tmpl"})
+	})
+
+	w := testServe(handler, "GET", "/users")
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, `[{"Name":"a","Age":1,"Email":"a@x"},{"Name":"b","Age":2,"Email":""}]`, w.Body.String())
+	assert.EqualValues(t, "Accept", w.Header().Get("Vary"))
+
+	w = testServe(handler, "GET", "/users", "Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.EqualValues(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, `<p>a</p><p>b</p>`, w.Body.String())
+
+	w = testServe(handler, "GET", "/users", "Accept", "application/json;q=0, text/*;q=0.5, text/csv")
+	assert.EqualValues(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "name,Age\na,1\nb,2\n", w.Body.String())
+
+	// application/json is rejected, the first acceptable offered format is html
+	w = testServe(handler, "GET", "/users", "Accept", "application/json;q=0, */*")
+	assert.EqualValues(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+
+	assert.EqualValues(t, "text/csv; charset=utf-8", testServe(handler, "GET", "/users.csv", "Accept", "application/json").Header().Get("Content-Type"))
+	assert.EqualValues(t, "text/plain; charset=utf-8", testServe(handler, "GET", "/users?format=text").Header().Get("Content-Type"))
+
+	w = testServe(handler, "GET", "/users", "Accept", "image/png")
+	assert.EqualValues(t, http.StatusNotAcceptable, w.Code)
+	assert.EqualValues(t, "Accept", w.Header().Get("Vary"))
+	assert.EqualValues(t, http.StatusNotAcceptable, testServe(handler, "GET", "/users?format=yaml").Code)
+
+	w = testServe(handler, "GET", "/users?data=map", "Accept", "text/xml")
+	assert.EqualValues(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<response><Name>a</Name><Tags><item>x</item><item>y</item></Tags></response>`, w.Body.String())
+	assert.EqualValues(t, http.StatusNotAcceptable, testServe(handler, "GET", "/users?data=map", "Accept", "application/json").Code)
+
+	// the slices and the typed maps are wrapped by one root element
+	w = testServe(handler, "GET", "/users", "Accept", "application/xml")
+	assert.EqualValues(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<response><item><Name>a</Name><Age>1</Age><Email>a@x</Email></item><item><Name>b</Name><Age>2</Age><Email></Email></item></response>`, w.Body.String())
+	w = testServe(handler, "GET", "/users?data=strings", "Accept", "application/xml")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<response><a>1</a><b>2</b></response>`, w.Body.String())
+
+	w = testServe(handler, "GET", "/users?data=int-keys", "Accept", "text/csv")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "10,2\nj,b\n,c\n", w.Body.String())
+}
+
+func TestNegotiateCsvData(t *testing.T) {
+	type user struct{ Name string }
+	assert.True(t, isCsvData([]user{}))
+	assert.True(t, isCsvData([]*user(nil)))
+	assert.True(t, isCsvData([]map[string]any{}))
+	assert.True(t, isCsvData([][]string{}))
+	assert.True(t, isCsvData([][2]int{}))
+	assert.True(t, isCsvData([]any{&user{}, user{}}))
+	assert.False(t, isCsvData([]any{map[string]any{}, &user{}}))
+	assert.False(t, isCsvData(nil))
+	assert.False(t, isCsvData(user{}))
+	assert.False(t, isCsvData([]int{1, 2}))
+	assert.False(t, isCsvData([]string{"a"}))
+	assert.False(t, isCsvData([]any{user{}, 1}))
+
+	// the OpenAPI document offers the formats by the zero value of the output type
+	opt := &NegotiateOptions{}
+	assert.Contains(t, opt.offeredFormats(reflect.Zero(reflect.TypeFor[[]user]()).Interface()), FormatCsv)
+	assert.NotContains(t, opt.offeredFormats(reflect.Zero(reflect.TypeFor[[]int]()).Interface()), FormatCsv)
+
+	csvData, err := encodeCsv([][2]int{{1, 2}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, "1,2\n", string(csvData))
+
+	type other struct{ Title string }
+	_, err = encodeCsv([]any{user{Name: "a"}, other{Title: "b"}})
+	assert.ErrorContains(t, err, "different types")
+}
@@ -0,0 +1,461 @@
+package fmhttp
+
+import (
+	"encoding"
+	"encoding/json"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"gopkg.in/yaml.v3"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OpenApiOptions struct {
+	Title       string
+	Version     string
+	Description string
+	// Servers are the base URLs of the API, eg: "https://api.example.com"
+	Servers []string
+
+	// UiAsset is an HTML page in the assets (AssetsWebRoot) served at the document route, eg: "swagger-ui.html".
+	// The page could load the document from the relative URL "{route}.json".
+	UiAsset string
+}
+
+var openApiDefaultOptions = OpenApiOptions{
+	Title:   "API",
+	Version: "1.0.0",
+}
+
+const openApiProblemSchema = "Problem"
+
+var (
+	typeTime            = reflect.TypeOf(time.Time{})
+	typeTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeJsonMarshaler   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeResponse        = reflect.TypeOf((*Response)(nil)).Elem()
+	openApiSchemaNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+type openApiGenerator struct {
+	schemas     map[string]any
+	schemaTypes map[reflect.Type]string
+}
+
+// GenerateOpenApi generates an OpenAPI 3.1 document from the routes of the router tree, the typed handlers (see Typed)
+// have the parameters, request bodies and responses reflected from their types:
+//   - the fields tagged by "path", "query" and "header" are the parameters, the "json" (or "form") fields are the request body
+//   - the "validate" tags are the constraints, eg: required, minimum, maxLength, enum
+//   - the "doc" tags are the descriptions
+//
+// The other handlers only have the path parameters. The wildcard routes and the Any routes are not included.
+func GenerateOpenApi(r Router, opts ...OpenApiOptions) map[string]any {
+	opt := fmutil.Def(opts, openApiDefaultOptions)
+	gen := &openApiGenerator{
+		schemas:     map[string]any{},
+		schemaTypes: map[reflect.Type]string{},
+	}
+	gen.schemas[openApiProblemSchema] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"type":     map[string]any{"type": "string"},
+			"title":    map[string]any{"type": "string"},
+			"status":   map[string]any{"type": "integer"},
+			"detail":   map[string]any{"type": "string"},
+			"code":     map[string]any{"type": "string"},
+			"instance": map[string]any{"type": "string"},
+		},
+	}
+
+	root, ok := r.(*routerImpl)
+	fmutil.MustTrue(ok, "unsupported router type: %T", r)
+	for root.parent != nil {
+		root = root.parent
+	}
+	paths := map[string]any{}
+	gen.walkRouter(root, "", paths)
+
+	info := map[string]any{"title": fmutil.IfZero(opt.Title, openApiDefaultOptions.Title), "version": fmutil.IfZero(opt.Version, openApiDefaultOptions.Version)}
+	if opt.Description != "" {
+		info["description"] = opt.Description
+	}
+	doc := map[string]any{
+		"openapi":    "3.1.0",
+		"info":       info,
+		"paths":      paths,
+		"components": map[string]any{"schemas": gen.schemas},
+	}
+	if len(opt.Servers) != 0 {
+		var servers []any
+		for _, s := range opt.Servers {
+			servers = append(servers, map[string]any{"url": s})
+		}
+		doc["servers"] = servers
+	}
+	return doc
+}
+
+// walkRouter walks the routes in the sorted order, so the colliding schema names are qualified deterministically
+func (gen *openApiGenerator) walkRouter(r *routerImpl, path string, paths map[string]any) {
+	if len(r.handlerMethodMap) != 0 {
+		item := map[string]any{}
+		for _, method := range slices.Sorted(maps.Keys(httpMethodTypeMap)) {
+			if chain, ok := r.handlerMethodMap[httpMethodTypeMap[method]]; ok {
+				item[strings.ToLower(method)] = gen.operation(method, path, chain)
+			}
+		}
+		if len(item) != 0 {
+			paths[fmutil.IfZero(path, "/")] = item
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(r.fixedFields)) {
+		if field != pathPatternWildcardField {
+			gen.walkRouter(r.fixedFields[field].(*routerImpl), path+"/"+field, paths)
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(r.paramFields)) {
+		gen.walkRouter(r.paramFields[field].(*routerImpl), path+"/"+field, paths)
+	}
+}
+
+func openApiPathParams(path string) (names []string) {
+	for _, field := range strings.Split(path, "/") {
+		if strings.Contains(field, "{") {
+			parts := splitRouteParamField(field)
+			for i := 1; i < len(parts); i += 2 {
+				names = append(names, parts[i])
+			}
+		}
+	}
+	return names
+}
+
+func (gen *openApiGenerator) operation(method, path string, chain *handlerChain) map[string]any {
+	op := map[string]any{}
+	var params []any
+	pathParams := openApiPathParams(path)
+	typed, _ := chain.endpoint.source.(*TypedHandler)
+	if typed == nil {
+		for _, name := range pathParams {
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		if len(params) != 0 {
+			op["parameters"] = params
+		}
+		op["responses"] = map[string]any{"default": map[string]any{"description": "Response"}}
+		return op
+	}
+
+	if typed.Doc.OperationID != "" {
+		op["operationId"] = typed.Doc.OperationID
+	}
+	if typed.Doc.Summary != "" {
+		op["summary"] = typed.Doc.Summary
+	}
+	if typed.Doc.Description != "" {
+		op["description"] = typed.Doc.Description
+	}
+	if len(typed.Doc.Tags) != 0 {
+		op["tags"] = typed.Doc.Tags
+	}
+	if typed.Doc.Deprecated {
+		op["deprecated"] = true
+	}
+
+	inType := typed.InType
+	if inType.Kind() == reflect.Pointer {
+		inType = inType.Elem()
+	}
+	documented := map[string]bool{}
+	bodyFields := map[string]any{}
+	var bodyRequired []string
+	hasParams := false
+	openApiStructFields(inType, func(sf reflect.StructField) {
+		for _, source := range []string{"path", "query", "header"} {
+			name, _, _ := strings.Cut(sf.Tag.Get(source), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			hasParams = true
+			param := map[string]any{"name": name, "in": source, "schema": gen.fieldSchema(sf)}
+			if source == "path" {
+				documented[name] = true
+				param["required"] = true
+			} else if openApiFieldRequired(sf) {
+				param["required"] = true
+			}
+			if desc := sf.Tag.Get("doc"); desc != "" {
+				param["description"] = desc
+			}
+			params = append(params, param)
+			return
+		}
+		if name := openApiJsonName(sf, "json", "form"); name != "" {
+			bodyFields[name] = gen.fieldSchema(sf)
+			if openApiFieldRequired(sf) {
+				bodyRequired = append(bodyRequired, name)
+			}
+		}
+	})
+	for _, name := range pathParams {
+		if !documented[name] {
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+	}
+	if len(params) != 0 {
+		op["parameters"] = params
+	}
+
+	if len(bodyFields) != 0 && method != http.MethodGet && method != http.MethodHead && method != http.MethodDelete {
+		var bodySchema any
+		if hasParams {
+			body := map[string]any{"type": "object", "properties": bodyFields}
+			if len(bodyRequired) != 0 {
+				sort.Strings(bodyRequired)
+				body["required"] = bodyRequired
+			}
+			bodySchema = body
+		} else {
+			bodySchema = gen.schema(inType)
+		}
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json":                  map[string]any{"schema": bodySchema},
+				"application/x-www-form-urlencoded": map[string]any{"schema": bodySchema},
+			},
+		}
+	}
+
+	problem := map[string]any{"application/problem+json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/" + openApiProblemSchema}}}
+	responses := map[string]any{"default": map[string]any{"description": "Error", "content": problem}}
+	status := strconv.Itoa(fmutil.IfZero(typed.opt.StatusCode, http.StatusOK))
+	if typed.OutType.Implements(typeResponse) {
+		responses[status] = map[string]any{"description": http.StatusText(fmutil.IfZero(typed.opt.StatusCode, http.StatusOK))}
+	} else {
+		content := map[string]any{}
+		for _, format := range typed.opt.offeredFormats(reflect.Zero(typed.OutType).Interface()) {
+			mediaType := negotiateFormatMediaTypes[format][0]
+			if format == FormatJson || format == FormatXml {
+				content[mediaType] = map[string]any{"schema": gen.schema(typed.OutType)}
+			} else {
+				content[mediaType] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+		}
+		responses[status] = map[string]any{"description": http.StatusText(fmutil.IfZero(typed.opt.StatusCode, http.StatusOK)), "content": content}
+		if typed.OutType.Kind() == reflect.Pointer {
+			responses[strconv.Itoa(http.StatusNoContent)] = map[string]any{"description": http.StatusText(http.StatusNoContent)}
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+// openApiStructFields calls fn for the exported fields, the fields of the embedded structs are promoted
+func openApiStructFields(t reflect.Type, fn func(sf reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && sf.Tag.Get("json") == "" {
+			openApiStructFields(sf.Type, fn)
+			continue
+		}
+		if sf.IsExported() {
+			fn(sf)
+		}
+	}
+}
+
+// openApiJsonName returns the name of the field by the first tag which has it, or the field name. It is empty if the field is skipped.
+func openApiJsonName(sf reflect.StructField, tags ...string) string {
+	for _, tag := range tags {
+		name, _, _ := strings.Cut(sf.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		} else if name != "" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+func openApiFieldRequired(sf reflect.StructField) bool {
+	for _, rule := range strings.Split(sf.Tag.Get("validate"), ",") {
+		if strings.TrimSpace(rule) == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func (gen *openApiGenerator) schemaName(t reflect.Type) string {
+	name := openApiSchemaNameRe.ReplaceAllString(t.Name(), "_")
+	for other, used := range gen.schemaTypes {
+		if used == name && other != t {
+			name = openApiSchemaNameRe.ReplaceAllString(strings.ReplaceAll(t.PkgPath(), "/", ".")+"."+t.Name(), "_")
+			break
+		}
+	}
+	return name
+}
+
+func (gen *openApiGenerator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == typeTime:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Implements(typeJsonMarshaler) || reflect.PointerTo(t).Implements(typeJsonMarshaler):
+		return map[string]any{}
+	case t.Implements(typeTextMarshaler) || reflect.PointerTo(t).Implements(typeTextMarshaler):
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return map[string]any{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": gen.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": gen.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return gen.structSchema(t)
+		}
+		name, ok := gen.schemaTypes[t]
+		if !ok {
+			name = gen.schemaName(t)
+			gen.schemaTypes[t] = name
+			gen.schemas[name] = map[string]any{} // the placeholder for the recursive types
+			gen.schemas[name] = gen.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func (gen *openApiGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	openApiStructFields(t, func(sf reflect.StructField) {
+		name := openApiJsonName(sf, "json")
+		if name == "" {
+			return
+		}
+		properties[name] = gen.fieldSchema(sf)
+		if openApiFieldRequired(sf) {
+			required = append(required, name)
+		}
+	})
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fieldSchema is the schema of the field type with the constraints of the "validate" tag and the description of the "doc" tag
+func (gen *openApiGenerator) fieldSchema(sf reflect.StructField) any {
+	schema := gen.schema(sf.Type)
+	if _, isRef := schema["$ref"]; isRef {
+		if desc := sf.Tag.Get("doc"); desc != "" {
+			return map[string]any{"allOf": []any{schema}, "description": desc}
+		}
+		return schema
+	}
+	if desc := sf.Tag.Get("doc"); desc != "" {
+		schema["description"] = desc
+	}
+	for _, rule := range strings.Split(sf.Tag.Get("validate"), ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			switch schema["type"] {
+			case "string":
+				schema[name+"Length"] = limit
+			case "array":
+				schema[name+"Items"] = limit
+			case "object":
+				schema[name+"Properties"] = limit
+			default:
+				schema[fmutil.Iif(name == "min", "minimum", "maximum")] = limit
+			}
+		case "oneof":
+			var enum []any
+			for _, s := range strings.Fields(arg) {
+				if schema["type"] == "integer" || schema["type"] == "number" {
+					if v, err := strconv.ParseFloat(s, 64); err == nil {
+						enum = append(enum, v)
+						continue
+					}
+				}
+				enum = append(enum, s)
+			}
+			schema["enum"] = enum
+		case "email":
+			schema["format"] = "email"
+		}
+	}
+	return schema
+}
+
+// ServeOpenApi serves the document of the whole router tree at "{pattern}.json" and "{pattern}.yaml",
+// and the UiAsset page at the pattern if it is set. The document is generated at the first request.
+func ServeOpenApi(r Router, pattern string, opts ...OpenApiOptions) {
+	opt := fmutil.Def(opts, openApiDefaultOptions)
+	var once sync.Once
+	var docJson, docYaml []byte
+	var docErr error
+	respondDoc := func(c *Context, yamlFormat bool) Response {
+		once.Do(func() {
+			doc := GenerateOpenApi(r, opt)
+			if docJson, docErr = json.MarshalIndent(doc, "", "  "); docErr == nil {
+				docYaml, docErr = yaml.Marshal(doc)
+			}
+		})
+		if docErr != nil {
+			return c.Respond(docErr)
+		}
+		resp := c.Respond(fmutil.Iif(yamlFormat, docYaml, docJson))
+		resp.Header().Set(headerContentType, fmutil.Iif(yamlFormat, "application/yaml", "application/json"))
+		return resp
+	}
+	r.Get(pattern+".json", func(c *Context) Response {
+		return respondDoc(c, false)
+	})
+	r.Get(pattern+".yaml", func(c *Context) Response {
+		return respondDoc(c, true)
+	})
+	if opt.UiAsset != "" {
+		r.Get(pattern, func(c *Context) Response {
+			return c.HttpServer.respondAsset(c, opt.UiAsset)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package fmhttp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/url"
+	"testing"
+	"testing/fstest"
+)
+
+type testApiUser struct {
+	ID      int64          `json:"id"`
+	Name    string         `json:"name" doc:"the display name"`
+	Friends []*testApiUser `json:"friends,omitempty"`
+}
+
+type testApiCreateUser struct {
+	Name  string `json:"name" validate:"required,max=20"`
+	Email string `json:"email" validate:"email"`
+	Role  string `json:"role" validate:"oneof=admin member"`
+}
+
+type testApiGetUser struct {
+	ID      int64  `path:"id" validate:"min=1" doc:"the user ID"`
+	Expand  bool   `query:"expand"`
+	TraceID string `header:"X-Trace-Id"`
+}
+
+func TestOpenApi(t *testing.T) {
+	hs := testHttpServer(&Options{AssetsFS: fstest.MapFS{
+		"assets/web/swagger.html": {Data: []byte(`<html>swagger</html>`)},
+	}})
+	r := NewRouter()
+	r.Route("/api", func(r Router) {
+		r.Get("/users/{id}", Typed(func(c *Context, in testApiGetUser) (*testApiUser, error) {
+			return &testApiUser{ID: in.ID}, nil
+		}, NegotiateOptions{Formats: []string{FormatJson}}).WithDoc(ApiDoc{OperationID: "getUser", Tags: []string{"users"}}))
+		r.Post("/users", Typed(func(c *Context, in testApiCreateUser) (*testApiUser, error) {
+			return &testApiUser{Name: in.Name}, nil
+		}, NegotiateOptions{Formats: []string{FormatJson}, StatusCode: http.StatusCreated}))
+		r.Get("/files/{name}.txt", func(c *Context) Response { return nil })
+		ServeOpenApi(r, "/openapi", OpenApiOptions{Title: "Test API", UiAsset: "swagger.html"})
+	})
+	r.Get("/static/**", func(c *Context) Response { return nil })
+
+	doc := GenerateOpenApi(r, OpenApiOptions{Title: "Test API"})
+	buf, _ := json.Marshal(doc)
+	var spec map[string]any
+	assert.NoError(t, json.Unmarshal(buf, &spec))
+	assert.EqualValues(t, "3.1.0", spec["openapi"])
+	assert.EqualValues(t, "Test API", spec["info"].(map[string]any)["title"])
+
+	paths := spec["paths"].(map[string]any)
+	assert.Contains(t, paths, "/api/users/{id}")
+	assert.Contains(t, paths, "/api/files/{name}.txt")
+	assert.Contains(t, paths, "/api/openapi.json")
+	assert.NotContains(t, paths, "/static/**")
+
+	getUser := paths["/api/users/{id}"].(map[string]any)["get"].(map[string]any)
+	assert.EqualValues(t, "getUser", getUser["operationId"])
+	getUserJson, _ := json.Marshal(getUser)
+	assert.JSONEq(t, `{
+		"operationId": "getUser",
+		"tags": ["users"],
+		"parameters": [
+			{"name": "id", "in": "path", "required": true, "description": "the user ID", "schema": {"type": "integer", "format": "int64", "minimum": 1, "description": "the user ID"}},
+			{"name": "expand", "in": "query", "schema": {"type": "boolean"}},
+			{"name": "X-Trace-Id", "in": "header", "schema": {"type": "string"}}
+		],
+		"responses": {
+			"200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/testApiUser"}}}},
+			"204": {"description": "No Content"},
+			"default": {"description": "Error", "content": {"application/problem+json": {"schema": {"$ref": "#/components/schemas/Problem"}}}}
+		}
+	}`, string(getUserJson))
+
+	createUser, _ := json.Marshal(paths["/api/users"].(map[string]any)["post"].(map[string]any)["requestBody"])
+	assert.JSONEq(t, `{"required": true, "content": {
+		"application/json": {"schema": {"$ref": "#/components/schemas/testApiCreateUser"}},
+		"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/testApiCreateUser"}}
+	}}`, string(createUser))
+	assert.Contains(t, paths["/api/users"].(map[string]any)["post"].(map[string]any)["responses"], "201")
+
+	schemas, _ := json.Marshal(spec["components"].(map[string]any)["schemas"])
+	var schemaMap map[string]any
+	_ = json.Unmarshal(schemas, &schemaMap)
+	userSchema, _ := json.Marshal(schemaMap["testApiUser"])
+	assert.JSONEq(t, `{"type": "object", "properties": {
+		"id": {"type": "integer", "format": "int64"},
+		"name": {"type": "string", "description": "the display name"},
+		"friends": {"type": "array", "items": {"$ref": "#/components/schemas/testApiUser"}}
+	}}`, string(userSchema))
+	createSchema, _ := json.Marshal(schemaMap["testApiCreateUser"])
+	assert.JSONEq(t, `{"type": "object", "required": ["name"], "properties": {
+		"name": {"type": "string", "maxLength": 20},
+		"email": {"type": "string", "format": "email"},
+		"role": {"type": "string", "enum": ["admin", "member"]}
+	}}`, string(createSchema))
+
+	filesOp, _ := json.Marshal(paths["/api/files/{name}.txt"])
+	assert.JSONEq(t, `{"get": {"parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}], "responses": {"default": {"description": "Response"}}}}`, string(filesOp))
+
+	handler := hs.wrapHandlers(r)
+	w := testServe(handler, "GET", "/api/openapi.json")
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(buf), w.Body.String())
+	w = testServe(handler, "GET", "/api/openapi.yaml")
+	assert.EqualValues(t, "application/yaml", w.Header().Get("Content-Type"))
+	var yamlSpec map[string]any
+	assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &yamlSpec))
+	assert.EqualValues(t, "3.1.0", yamlSpec["openapi"])
+	w = testServe(handler, "GET", "/api/openapi")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "<html>swagger</html>", w.Body.String())
+}
+
+// URL collides with the name of url.URL
+type URL struct {
+	Href string `json:"href"`
+}
+
+func TestOpenApiSchemaNameCollision(t *testing.T) {
+	r := NewRouter()
+	r.Get("/b", Typed(func(c *Context, in struct{}) (*url.URL, error) { return nil, nil }))
+	r.Get("/a", Typed(func(c *Context, in struct{}) (*URL, error) { return nil, nil }))
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		buf, _ := json.Marshal(GenerateOpenApi(r))
+		if first == nil {
+			first = buf
+		}
+		assert.JSONEq(t, string(first), string(buf))
+	}
+	schemas := GenerateOpenApi(r)["components"].(map[string]any)["schemas"].(map[string]any)
+	assert.Contains(t, schemas, "URL")
+	assert.Contains(t, schemas, "net.url.URL")
+	assert.Contains(t, schemas["URL"].(map[string]any)["properties"], "href")
+}
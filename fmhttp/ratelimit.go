@@ -0,0 +1,264 @@
+package fmhttp
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RateLimitSlidingWindow counts the requests of the current window plus the weighted requests of the previous one
+	RateLimitSlidingWindow = "sliding-window"
+	// RateLimitTokenBucket allows bursts up to the limit, the tokens are refilled at Limit/Window
+	RateLimitTokenBucket = "token-bucket"
+)
+
+// RateLimitRule is the limit of the requests of a key in a store
+type RateLimitRule struct {
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the quota is fully restored
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, it is zero if the request is allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore counts the requests, a shared store (eg: Redis) could be used by multiple servers
+type RateLimitStore interface {
+	// Take consumes a request of the key by the rule
+	Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error)
+}
+
+type RateLimitOptions struct {
+	// Limit is the number of the requests allowed in the Window, eg: 10 requests per minute
+	Limit  int
+	Window time.Duration
+	// Algorithm is RateLimitSlidingWindow (default) or RateLimitTokenBucket
+	Algorithm string
+
+	// Key returns the client of the request, default is RateLimitByIp. The request is not limited if the key is empty.
+	Key func(c *Context) string
+	// Name separates the counters of the limiters in a shared store, eg: "login". Default is unique for each middleware.
+	Name string
+	// Store is shared by the limiters, default is a memory store for each middleware
+	Store RateLimitStore
+
+	// ErrorHandler responds when the limit is exceeded, default is a 429 response. The Retry-After header is already set.
+	ErrorHandler RequestHandlerFunc
+}
+
+var rateLimitDefaultOptions = RateLimitOptions{
+	Limit:     60,
+	Window:    time.Minute,
+	Algorithm: RateLimitSlidingWindow,
+	Key:       RateLimitByIp,
+	ErrorHandler: func(c *Context) Response {
+		return c.Respond(NewHttpError(http.StatusTooManyRequests, "too many requests").WithCode("rate_limited"))
+	},
+}
+
+var rateLimitNameCounter atomic.Int64
+
+// RateLimitByIp keys the requests by the real remote IP
+func RateLimitByIp(c *Context) string {
+	return "ip:" + c.RealRemoteIp()
+}
+
+// RateLimitBySessionValue keys the requests by a session value (eg: the user ID), the anonymous requests are keyed by IP
+func RateLimitBySessionValue(sessionKey string) func(c *Context) string {
+	return func(c *Context) string {
+		if session := c.Session(); session != nil {
+			if v := session.Get(sessionKey); v != nil && v != "" {
+				return fmt.Sprintf("session:%v", v)
+			}
+		}
+		return RateLimitByIp(c)
+	}
+}
+
+func durationSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// RateLimit limits the requests of each client, it could be scoped to a route group, eg:
+//
+//	r.With(fmhttp.RateLimit(fmhttp.RateLimitOptions{Limit: 5, Window: time.Minute})).Group(func(r fmhttp.Router) { r.Post("/login", login) })
+//
+// The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers are added to the responses.
+// If the store fails, the request is allowed and the error is logged.
+func RateLimit(opts ...RateLimitOptions) func(ce *ChainExecutor) Response {
+	opt := fmutil.Def(opts, rateLimitDefaultOptions)
+	opt.Limit = fmutil.IfZero(opt.Limit, rateLimitDefaultOptions.Limit)
+	opt.Window = fmutil.IfZero(opt.Window, rateLimitDefaultOptions.Window)
+	opt.Algorithm = fmutil.IfZero(opt.Algorithm, rateLimitDefaultOptions.Algorithm)
+	opt.Key = fmutil.IfZero(opt.Key, rateLimitDefaultOptions.Key)
+	opt.ErrorHandler = fmutil.IfZero(opt.ErrorHandler, rateLimitDefaultOptions.ErrorHandler)
+	opt.Name = fmutil.IfZero(opt.Name, "limiter"+strconv.FormatInt(rateLimitNameCounter.Add(1), 10))
+	if opt.Store == nil {
+		opt.Store = NewMemoryRateLimitStore()
+	}
+	fmutil.MustTrue(opt.Algorithm == RateLimitSlidingWindow || opt.Algorithm == RateLimitTokenBucket, "unknown rate limit algorithm: %s", opt.Algorithm)
+	rule := RateLimitRule{Algorithm: opt.Algorithm, Limit: opt.Limit, Window: opt.Window}
+
+	return func(ce *ChainExecutor) Response {
+		c := ce.context
+		key := opt.Key(c)
+		if key == "" {
+			return ce.Next()
+		}
+		result, err := opt.Store.Take(c, opt.Name+":"+key, rule)
+		if err != nil {
+			fmlog.Errorf("fmhttp: rate limit store error for %s, err: %v", key, err)
+			return ce.Next()
+		}
+
+		h := c.ResponseWriter.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		h.Set("RateLimit-Reset", durationSeconds(result.Reset))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", opt.Limit, durationSeconds(opt.Window)))
+		if !result.Allowed {
+			h.Set("Retry-After", durationSeconds(result.RetryAfter))
+			return opt.ErrorHandler(c)
+		}
+		return ce.Next()
+	}
+}
+
+const rateLimitStoreShards = 32
+
+type rateLimitEntry struct {
+	// the token bucket
+	tokens float64
+	// the sliding window
+	windowStart time.Time
+	prevCount   int
+	currCount   int
+
+	updated time.Time
+	expire  time.Duration
+}
+
+type rateLimitShard struct {
+	mu        sync.Mutex
+	entries   map[string]*rateLimitEntry
+	nextSweep time.Time
+}
+
+// MemoryRateLimitStore is a sharded in-memory store, the idle entries are removed periodically
+type MemoryRateLimitStore struct {
+	shards [rateLimitStoreShards]rateLimitShard
+	now    func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{now: time.Now}
+	for i := range s.shards {
+		s.shards[i].entries = map[string]*rateLimitEntry{}
+	}
+	return s
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	shard := &s.shards[h.Sum32()%rateLimitStoreShards]
+	now := s.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if now.After(shard.nextSweep) {
+		for k, e := range shard.entries {
+			if now.Sub(e.updated) > e.expire {
+				delete(shard.entries, k)
+			}
+		}
+		shard.nextSweep = now.Add(time.Minute)
+	}
+
+	e := shard.entries[key]
+	if e == nil {
+		e = &rateLimitEntry{tokens: float64(rule.Limit), windowStart: now.Truncate(rule.Window), updated: now}
+		shard.entries[key] = e
+	}
+	// the entry is idle when the bucket is full again, or the previous window is over
+	e.expire = 2 * rule.Window
+	if rule.Algorithm == RateLimitTokenBucket {
+		return e.takeTokenBucket(now, rule), nil
+	}
+	return e.takeSlidingWindow(now, rule), nil
+}
+
+func (e *rateLimitEntry) takeTokenBucket(now time.Time, rule RateLimitRule) RateLimitResult {
+	capacity := float64(rule.Limit)
+	rate := capacity / rule.Window.Seconds()
+	e.tokens = math.Min(capacity, e.tokens+now.Sub(e.updated).Seconds()*rate)
+	e.updated = now
+
+	result := RateLimitResult{Limit: rule.Limit}
+	if e.tokens >= 1 {
+		e.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - e.tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(e.tokens)
+	result.Reset = time.Duration((capacity - e.tokens) / rate * float64(time.Second))
+	return result
+}
+
+func (e *rateLimitEntry) takeSlidingWindow(now time.Time, rule RateLimitRule) RateLimitResult {
+	windowStart := now.Truncate(rule.Window)
+	if !windowStart.Equal(e.windowStart) {
+		if windowStart.Sub(e.windowStart) == rule.Window {
+			e.prevCount = e.currCount
+		} else {
+			e.prevCount = 0
+		}
+		e.currCount = 0
+		e.windowStart = windowStart
+	}
+	e.updated = now
+
+	elapsed := float64(now.Sub(windowStart)) / float64(rule.Window)
+	estimated := float64(e.prevCount)*(1-elapsed) + float64(e.currCount)
+	result := RateLimitResult{Limit: rule.Limit, Reset: windowStart.Add(rule.Window).Sub(now)}
+	if estimated+1 <= float64(rule.Limit) {
+		e.currCount++
+		result.Allowed = true
+		result.Remaining = max(0, rule.Limit-int(math.Ceil(estimated+1)))
+	}
+	// the requests of the current window are weighted in the next window too
+	if e.currCount != 0 {
+		result.Reset += rule.Window
+	}
+	if result.Allowed {
+		return result
+	}
+
+	// the time until the estimated count drops below the limit
+	limit := float64(rule.Limit - 1)
+	if e.currCount <= rule.Limit-1 {
+		x := 1 - (limit-float64(e.currCount))/float64(e.prevCount)
+		result.RetryAfter = time.Duration(x*float64(rule.Window)) - now.Sub(windowStart)
+	} else {
+		x := math.Max(0, 1-limit/float64(e.currCount))
+		result.RetryAfter = windowStart.Add(rule.Window).Sub(now) + time.Duration(x*float64(rule.Window))
+	}
+	return result
+}
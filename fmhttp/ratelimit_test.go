@@ -0,0 +1,121 @@
+package fmhttp
+
+import (
+	"context"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	rule := RateLimitRule{Algorithm: RateLimitTokenBucket, Limit: 3, Window: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		result, _ := store.Take(context.Background(), "k", rule)
+		assert.True(t, result.Allowed)
+		assert.EqualValues(t, i, result.Remaining)
+	}
+	result, _ := store.Take(context.Background(), "k", rule)
+	assert.False(t, result.Allowed)
+	assert.EqualValues(t, time.Second, result.RetryAfter)
+	assert.EqualValues(t, 3*time.Second, result.Reset)
+
+	// a token is refilled every second
+	now = now.Add(time.Second)
+	result, _ = store.Take(context.Background(), "k", rule)
+	assert.True(t, result.Allowed)
+	result, _ = store.Take(context.Background(), "other", rule)
+	assert.EqualValues(t, 2, result.Remaining)
+}
+
+func TestRateLimitSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	rule := RateLimitRule{Algorithm: RateLimitSlidingWindow, Limit: 4, Window: time.Minute}
+
+	for i := 0; i < 4; i++ {
+		result, _ := store.Take(context.Background(), "k", rule)
+		assert.True(t, result.Allowed)
+		assert.EqualValues(t, 3-i, result.Remaining)
+	}
+	result, _ := store.Take(context.Background(), "k", rule)
+	assert.False(t, result.Allowed)
+	// the next window starts at 1 minute, the previous 4 requests are weighted until 15 seconds later
+	assert.EqualValues(t, 75*time.Second, result.RetryAfter)
+
+	// at 30s of the next window, 4*0.5 requests of the previous window are counted
+	now = now.Add(90 * time.Second)
+	for i := 0; i < 2; i++ {
+		result, _ = store.Take(context.Background(), "k", rule)
+		assert.True(t, result.Allowed)
+	}
+	result, _ = store.Take(context.Background(), "k", rule)
+	assert.False(t, result.Allowed)
+	assert.EqualValues(t, 15*time.Second, result.RetryAfter)
+
+	// the idle entries are removed from the shard
+	var old *rateLimitEntry
+	for i := range store.shards {
+		old = fmutil.IfZero(store.shards[i].entries["k"], old)
+	}
+	now = now.Add(3 * time.Minute)
+	result, _ = store.Take(context.Background(), "k", rule)
+	assert.EqualValues(t, 3, result.Remaining)
+	for i := range store.shards {
+		if e := store.shards[i].entries["k"]; e != nil {
+			assert.NotSame(t, old, e)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Get("/api", func(c *Context) Response { return c.Respond("api") })
+	r.With(RateLimit(RateLimitOptions{Limit: 2, Window: time.Minute})).Group(func(r Router) {
+		r.Post("/login", func(c *Context) Response { return c.Respond("login") })
+	})
+	r.With(RateLimit(RateLimitOptions{Limit: 1, Window: time.Minute, Key: func(c *Context) string { return c.Request.Header.Get("X-Api-Key") }})).Group(func(r Router) {
+		r.Get("/keyed", func(c *Context) Response { return c.Respond("keyed") })
+	})
+	handler := hs.wrapHandlers(r)
+	serve := func(method, target, ip string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip + ":1234"
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return testServeRequest(handler, req)
+	}
+
+	w := serve("POST", "/login", "10.0.0.1")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.EqualValues(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.EqualValues(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	assert.EqualValues(t, http.StatusOK, serve("POST", "/login", "10.0.0.1").Code)
+	w = serve("POST", "/login", "10.0.0.1")
+	assert.EqualValues(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.EqualValues(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Contains(t, w.Body.String(), "rate_limited")
+
+	// the limit is scoped to the route and the client
+	assert.EqualValues(t, http.StatusOK, serve("POST", "/login", "10.0.0.2").Code)
+	w = serve("GET", "/api", "10.0.0.1")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+	// the requests without the key are not limited
+	assert.EqualValues(t, http.StatusOK, serve("GET", "/keyed", "10.0.0.1", "X-Api-Key", "a").Code)
+	assert.EqualValues(t, http.StatusTooManyRequests, serve("GET", "/keyed", "10.0.0.1", "X-Api-Key", "a").Code)
+	assert.EqualValues(t, http.StatusOK, serve("GET", "/keyed", "10.0.0.1").Code)
+	assert.EqualValues(t, http.StatusOK, serve("GET", "/keyed", "10.0.0.1").Code)
+}
@@ -1,8 +1,11 @@
 package fmhttp
 
 import (
+	"bufio"
+	"github.com/go-farmyard/farmyard/fmlog"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
 )
@@ -31,41 +34,94 @@ func (w *ResponseWriterWrapper) WriteHeader(statusCode int) {
 	w.responseWriter.WriteHeader(statusCode)
 }
 
-type responderTmpl struct {
-	req  *Context
-	name string
-	data map[string]any
+// Flush sends the buffered data to the client, it does nothing if the underlying writer doesn't support flushing
+func (w *ResponseWriterWrapper) Flush() {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	_ = http.NewResponseController(w.responseWriter).Flush()
 }
 
-func (r responderTmpl) WriteTo(_ io.Writer) (n int64, err error) {
-	var tmplData map[string]any
-	if len(r.data) == 0 {
-		tmplData = r.req.HandlerData
-	} else if len(r.req.HandlerData) == 0 {
-		tmplData = r.data
+// ReadFrom copies the reader to the response, the underlying writer could use sendfile for the files
+func (w *ResponseWriterWrapper) ReadFrom(r io.Reader) (int64, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.responseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
 	} else {
-		tmplData = map[string]any{}
-		for k, v := range r.req.HandlerData {
-			tmplData[k] = v
-		}
-		for k, v := range r.data {
-			tmplData[k] = v
-		}
+		n, err = io.Copy(struct{ io.Writer }{w.responseWriter}, r)
 	}
+	w.written += n
+	return n, err
+}
 
-	respWriter := r.req.ResponseWriter
-	err = r.req.HttpServer.TmplRender(respWriter, r.name, tmplData)
+// Unwrap returns the underlying writer for http.ResponseController, eg: SetWriteDeadline, EnableFullDuplex
+func (w *ResponseWriterWrapper) Unwrap() http.ResponseWriter {
+	return w.responseWriter
+}
+
+// Hijack takes over the connection, eg: WebSocket. The compression middleware is skipped by http.ResponseController.
+func (w *ResponseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.responseWriter).Hijack()
+	if err == nil {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+type responderTmpl struct {
+	req    *Context
+	name   string
+	data   map[string]any
+	locale string
+}
+
+// statusResponder writes the status code by itself, eg: the template is rendered into a buffer before the status code
+// is written, so a failed rendering could still respond an error page
+type statusResponder interface {
+	respondWithStatus(w http.ResponseWriter, statusCode int) (int64, error)
+}
+
+func (r responderTmpl) tmplData(flashes *tmplFlashes) map[string]any {
+	// the flashes and the locale are only added if the handler doesn't provide them
+	tmplData := map[string]any{TmplDataKeyLocale: r.locale, TmplDataKeyFlashes: flashes}
+	for k, v := range r.req.HandlerData {
+		tmplData[k] = v
+	}
+	for k, v := range r.data {
+		tmplData[k] = v
+	}
+	return tmplData
+}
+
+func (r responderTmpl) respondWithStatus(w http.ResponseWriter, statusCode int) (int64, error) {
+	buf := getRenderBuffer()
+	defer putRenderBuffer(buf)
+
+	flashes := &tmplFlashes{req: r.req}
+	err := r.req.HttpServer.TmplRender(buf, r.name, r.tmplData(flashes))
 	if err != nil {
-		if respWriter.written == 0 {
-			if os.IsNotExist(err) {
-				http.NotFound(respWriter, r.req.Request)
-			} else {
-				http.Error(respWriter, "internal error (render template error)", http.StatusInternalServerError)
-			}
+		if os.IsNotExist(err) {
+			http.NotFound(w, r.req.Request)
+		} else {
+			r.req.HttpServer.respondTmplError(w, r.name, err)
 		}
-		return respWriter.written, err
+		return 0, err
 	}
-	return respWriter.written, nil
+	// the flashes are only consumed if they are shown
+	if len(flashes.flashes) != 0 {
+		if err = r.req.removeShownFlashes(w); err != nil {
+			fmlog.Errorf("fmhttp: failed to remove the shown flashes, err: %v", err)
+		}
+	}
+
+	if len(w.Header()[headerContentType]) == 0 {
+		w.Header().Set(headerContentType, "text/html; charset=utf-8")
+	}
+	return writeBuffered(r.req, w, statusCode, buf.Bytes())
 }
 
 type responderFile struct {
@@ -74,13 +130,15 @@ type responderFile struct {
 	file fs.File
 }
 
-func (r responderFile) WriteTo(_ io.Writer) (n int64, err error) {
+// respondWithStatus ignores the status code, http.ServeContent responds 200, 206 (range) or 304 (not modified)
+func (r responderFile) respondWithStatus(w http.ResponseWriter, _ int) (n int64, err error) {
+	defer r.file.Close()
 	respWriter := r.req.ResponseWriter
 	st, err := r.file.Stat()
 	if err != nil {
-		http.Error(respWriter, "internal error (file stat error)", http.StatusInternalServerError)
+		http.Error(w, "internal error (file stat error)", http.StatusInternalServerError)
 		return respWriter.written, err
 	}
-	http.ServeContent(respWriter, r.req.Request, r.name, st.ModTime(), r.file.(io.ReadSeeker))
+	http.ServeContent(w, r.req.Request, r.name, st.ModTime(), r.file.(io.ReadSeeker))
 	return respWriter.written, nil
 }
@@ -46,17 +46,15 @@ func (wr *ResponseCommon) SetStatusCode(v int) *ResponseCommon {
 
 const headerContentType = "Content-Type" // canonical header
 
-func (wr *ResponseCommon) respondJson(v any) (int64, error) {
-	w := wr.request.ResponseWriter
-	if len(w.Header()[headerContentType]) == 0 {
-		w.Header().Add(headerContentType, "application/json")
-	}
+func (wr *ResponseCommon) respondJson(w http.ResponseWriter, v any) (int64, error) {
 	buf, err := json.Marshal(v)
 	if err != nil {
-		return 0, err
+		return wr.request.HttpServer.respondError(wr.request, w, 0, err)
+	}
+	if len(w.Header()[headerContentType]) == 0 {
+		w.Header().Add(headerContentType, "application/json")
 	}
-	n, err := w.Write(buf)
-	return int64(n), err
+	return writeBuffered(wr.request, w, wr.statusCode, buf)
 }
 
 func (wr *ResponseCommon) RespondTo(w http.ResponseWriter) (int64, error) {
@@ -81,31 +79,34 @@ func (wr *ResponseCommon) RespondTo(w http.ResponseWriter) (int64, error) {
 		return 0, nil
 	}
 
-	if wr.statusCode != 0 {
-		w.WriteHeader(wr.statusCode)
+	if err, ok := wr.respBody.(error); ok {
+		return wr.request.HttpServer.respondError(wr.request, w, wr.statusCode, err)
+	}
+	if v, ok := wr.respBody.(statusResponder); ok {
+		return v.respondWithStatus(w, wr.statusCode)
 	}
 
+	// the buffered bodies get the Content-Length, the ETag and the conditional request support
 	switch v := wr.respBody.(type) {
 	case []byte:
-		n, err := w.Write(v)
-		return int64(n), err
+		return writeBuffered(wr.request, w, wr.statusCode, v)
 	case string:
-		n, err := w.Write([]byte(v))
-		return int64(n), err
+		return writeBuffered(wr.request, w, wr.statusCode, []byte(v))
+	case map[string]any, map[any]any:
+		return wr.respondJson(w, v)
+	case fmutil.JsonDataProvider:
+		return wr.respondJson(w, v.JsonData())
+	}
+
+	if wr.statusCode != 0 {
+		w.WriteHeader(wr.statusCode)
+	}
+
+	switch v := wr.respBody.(type) {
 	case io.Reader:
 		return io.Copy(w, v)
 	case io.WriterTo:
 		return v.WriteTo(w)
-	case map[string]any, map[any]any:
-		return wr.respondJson(v)
-	case fmutil.JsonDataProvider:
-		return wr.respondJson(v.JsonData())
-	case error:
-		if wr.statusCode == 0 {
-			wr.statusCode = http.StatusInternalServerError
-			w.WriteHeader(wr.statusCode)
-		}
-		return wr.respondJson(fmutil.Map{"Error": v.Error()})
 	default:
 		if v != nil {
 			fmutil.Panic("unknown response body: %T", v)
@@ -1,14 +1,26 @@
 package fmhttp
 
 import (
+	"errors"
+	"github.com/go-farmyard/farmyard/fmlog"
 	"github.com/go-farmyard/farmyard/fmutil"
 	"github.com/gorilla/sessions"
+	"io/fs"
 	"net/http"
+	"time"
+)
+
+const (
+	sessionKeyCreatedAt    = "__fm_created_at"
+	sessionKeyLastActiveAt = "__fm_last_active_at"
 )
 
 type Session struct {
 	session *sessions.Session
 	changed bool
+
+	// the IDs replaced by Regenerate, their stored data are erased when saving
+	replacedIDs []string
 }
 
 func NewSession(session *sessions.Session) *Session {
@@ -44,6 +56,55 @@ func (ws *Session) Destroy() {
 	ws.changed = true
 }
 
+// Regenerate changes the session ID and keeps the values, it should be called after the user's privilege changes (eg: login)
+// to prevent session fixation attacks.
+func (ws *Session) Regenerate() {
+	if ws.session.ID != "" {
+		ws.replacedIDs = append(ws.replacedIDs, ws.session.ID)
+		ws.session.ID = ""
+	}
+	ws.session.Values[sessionKeyCreatedAt] = time.Now().Unix()
+	ws.changed = true
+}
+
+// CreatedAt is tracked if the session timeouts are set, or the session is regenerated
+func (ws *Session) CreatedAt() time.Time {
+	return time.Unix(fmutil.AsInt64(ws.session.Values[sessionKeyCreatedAt]), 0)
+}
+
+// enforceTimeouts clears the session values if the session has been idle or alive for too long,
+// and it refreshes the last active time, at most once per a small part of the idle timeout to avoid saving on every request.
+func (ws *Session) enforceTimeouts(idleTimeout, absoluteTimeout time.Duration) {
+	if idleTimeout == 0 && absoluteTimeout == 0 {
+		return
+	}
+	now := time.Now()
+	createdAt := fmutil.AsInt64(ws.session.Values[sessionKeyCreatedAt])
+	lastActiveAt := fmutil.AsInt64(ws.session.Values[sessionKeyLastActiveAt])
+	if createdAt == 0 {
+		// a new session, the metadata is saved together with the values when they are changed
+		ws.session.Values[sessionKeyCreatedAt] = now.Unix()
+		ws.session.Values[sessionKeyLastActiveAt] = now.Unix()
+		return
+	}
+
+	expired := absoluteTimeout > 0 && now.Sub(time.Unix(createdAt, 0)) > absoluteTimeout
+	expired = expired || idleTimeout > 0 && now.Sub(time.Unix(lastActiveAt, 0)) > idleTimeout
+	if expired {
+		for k := range ws.session.Values {
+			delete(ws.session.Values, k)
+		}
+		ws.Regenerate()
+		ws.session.Values[sessionKeyLastActiveAt] = now.Unix()
+		return
+	}
+
+	if idleTimeout > 0 && now.Sub(time.Unix(lastActiveAt, 0)) > idleTimeout/10 {
+		ws.session.Values[sessionKeyLastActiveAt] = now.Unix()
+		ws.changed = true
+	}
+}
+
 func (ws *Session) SetChanged() {
 	ws.changed = true
 }
@@ -51,7 +112,46 @@ func (ws *Session) SetChanged() {
 func (ws *Session) AutoSave(w http.ResponseWriter, r *http.Request) error {
 	if ws.changed {
 		ws.changed = false
-		return ws.session.Save(r, w)
+		// erasing the replaced sessions is best-effort, eg: the file of a FilesystemStore session may be already removed
+		for _, id := range ws.replacedIDs {
+			if err := ws.eraseReplaced(r, id); err != nil {
+				fmlog.Warnf("fmhttp: failed to erase the replaced session, err: %v", err)
+			}
+		}
+		ws.replacedIDs = nil
+		err := ws.session.Save(r, w)
+		if err != nil && ws.session.Options.MaxAge < 0 && errors.Is(err, fs.ErrNotExist) {
+			// the destroyed session has no stored data, only the cookie needs to be deleted
+			http.SetCookie(w, sessions.NewCookie(ws.session.Name(), "", ws.session.Options))
+			return nil
+		}
+		return err
 	}
 	return nil
 }
+
+// eraseReplaced erases the stored data of a replaced session by saving it as a deleted one,
+// the deletion cookie is discarded because the new session cookie will be sent.
+func (ws *Session) eraseReplaced(r *http.Request, id string) error {
+	replaced := sessions.NewSession(ws.session.Store(), ws.session.Name())
+	replaced.ID = id
+	opts := *ws.session.Options
+	opts.MaxAge = -1
+	replaced.Options = &opts
+	return replaced.Save(r, discardResponseWriter{header: http.Header{}})
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w discardResponseWriter) WriteHeader(_ int) {
+}
@@ -0,0 +1,200 @@
+package fmhttp
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type SessionStoreType string
+
+const (
+	SessionStoreFilesystem SessionStoreType = "filesystem"
+	SessionStoreCookie     SessionStoreType = "cookie"
+	SessionStoreMemory     SessionStoreType = "memory"
+	SessionStoreSql        SessionStoreType = "sql"
+)
+
+// SessionBackend stores the encoded session values on the server side, the session cookie only contains the signed session ID
+type SessionBackend interface {
+	Load(id string) (data []byte, found bool, err error)
+	Save(id string, data []byte, expiresAt time.Time) error
+	Delete(id string) error
+}
+
+// BackendSessionStore implements sessions.Store by a SessionBackend, it works like the gorilla's FilesystemStore
+type BackendSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	backend SessionBackend
+}
+
+var _ sessions.Store = (*BackendSessionStore)(nil)
+
+func NewBackendSessionStore(backend SessionBackend, keyPairs ...[]byte) *BackendSessionStore {
+	s := &BackendSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		backend: backend,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+func (s *BackendSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *BackendSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	data, found, err := s.backend.Load(session.ID)
+	if err != nil || !found {
+		// never reuse an unknown session ID from the client
+		session.ID = ""
+		return session, err
+	}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *BackendSessionStore) Save(_ *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := s.backend.Save(session.ID, buf.Bytes(), expiresAt); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie implementation
+func (s *BackendSessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+type SessionKeyPair struct {
+	HashKey string
+	// EncryptKey is optional, it is an AES key of 16, 24 or 32 bytes
+	EncryptKey string
+}
+
+func (opt *Options) sessionKeyPairs() (keyPairs [][]byte) {
+	keys := opt.SessionCookieKeys
+	if opt.SessionCookieSecureKey != "" || len(keys) == 0 {
+		keys = append(keys, SessionKeyPair{HashKey: opt.SessionCookieSecureKey, EncryptKey: opt.SessionCookieEncryptKey})
+	}
+	for _, key := range keys {
+		var encryptKey []byte
+		if key.EncryptKey != "" {
+			encryptKey = []byte(key.EncryptKey)
+		}
+		keyPairs = append(keyPairs, []byte(key.HashKey), encryptKey)
+	}
+	return keyPairs
+}
+
+func (opt *Options) defaultSessionCookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		Secure:   !opt.SessionCookieInsecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (hs *HttpServer) initSessionStore(opt *Options) {
+	hs.sessionIdleTimeout = opt.SessionIdleTimeout
+	hs.sessionAbsoluteTimeout = opt.SessionAbsoluteTimeout
+	if hs.sessionCookieOptions == nil {
+		hs.sessionCookieOptions = opt.defaultSessionCookieOptions()
+	}
+
+	if opt.SessionStore != nil {
+		hs.sessionStore = opt.SessionStore
+		return
+	}
+
+	// all the built-in stores have the Options field and the MaxAge method
+	var store interface {
+		sessions.Store
+		MaxAge(age int)
+	}
+	var storeOptions **sessions.Options
+
+	keyPairs := opt.sessionKeyPairs()
+	switch fmutil.IfZero(opt.SessionStoreType, SessionStoreFilesystem) {
+	case SessionStoreFilesystem:
+		ss := sessions.NewFilesystemStore(opt.SessionDir, keyPairs...)
+		store, storeOptions = ss, &ss.Options
+	case SessionStoreCookie:
+		fmutil.MustTrue(keyPairs[1] != nil, "cookie session store requires an encryption key")
+		ss := sessions.NewCookieStore(keyPairs...)
+		store, storeOptions = ss, &ss.Options
+	case SessionStoreMemory:
+		ss := NewMemorySessionStore(keyPairs...)
+		store, storeOptions = ss, &ss.Options
+	case SessionStoreSql:
+		fmutil.MustTrue(opt.SessionOrm != nil, "sql session store requires SessionOrm")
+		ss := NewSqlSessionStore(opt.SessionOrm, opt.SessionSqlTable, keyPairs...)
+		store, storeOptions = ss, &ss.Options
+	default:
+		fmutil.Panic("unknown session store type: %s", opt.SessionStoreType)
+	}
+	*storeOptions = hs.sessionCookieOptions
+	store.MaxAge(hs.sessionCookieOptions.MaxAge)
+	hs.sessionStore = store
+}
@@ -0,0 +1,75 @@
+package fmhttp
+
+import (
+	"sync"
+	"time"
+)
+
+const memorySessionSweepInterval = time.Minute
+
+type memorySessionEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// MemorySessionBackend keeps the sessions in the process memory, the expired sessions are evicted periodically when loading or saving.
+// The sessions are lost when the process restarts, and they are not shared between processes.
+type MemorySessionBackend struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySessionEntry
+	lastSweep time.Time
+}
+
+func NewMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{sessions: map[string]memorySessionEntry{}}
+}
+
+func NewMemorySessionStore(keyPairs ...[]byte) *BackendSessionStore {
+	return NewBackendSessionStore(NewMemorySessionBackend(), keyPairs...)
+}
+
+func (b *MemorySessionBackend) Load(id string) ([]byte, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweep(now)
+	entry, ok := b.sessions[id]
+	if !ok || !now.Before(entry.expiresAt) {
+		return nil, false, nil
+	}
+	return entry.data, true, nil
+}
+
+// sweep evicts the expired sessions if the last sweep is earlier than the interval, the lock must be held
+func (b *MemorySessionBackend) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < memorySessionSweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for k, entry := range b.sessions {
+		if !now.Before(entry.expiresAt) {
+			delete(b.sessions, k)
+		}
+	}
+}
+
+func (b *MemorySessionBackend) Save(id string, data []byte, expiresAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(time.Now())
+	b.sessions[id] = memorySessionEntry{data: data, expiresAt: expiresAt}
+	return nil
+}
+
+func (b *MemorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, id)
+	return nil
+}
+
+func (b *MemorySessionBackend) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.sessions)
+}
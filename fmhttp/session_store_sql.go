@@ -0,0 +1,83 @@
+package fmhttp
+
+import (
+	"github.com/go-farmyard/farmyard/fmorm"
+	"time"
+)
+
+const defaultSessionSqlTable = "fm_session"
+
+type sqlSessionRow struct {
+	ID        string `db:"id"`
+	Data      []byte `db:"data"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+// SqlSessionBackend stores the sessions in a SQL table, the table should be created like:
+//
+//	CREATE TABLE fm_session (id VARCHAR(64) PRIMARY KEY, data BLOB NOT NULL, expires_at BIGINT NOT NULL, INDEX (expires_at))
+//
+// The expired sessions are never loaded, DeleteExpired could be called periodically to clean them up.
+type SqlSessionBackend struct {
+	orm   *fmorm.Orm
+	table string
+}
+
+func NewSqlSessionBackend(orm *fmorm.Orm, table string) *SqlSessionBackend {
+	if table == "" {
+		table = defaultSessionSqlTable
+	}
+	return &SqlSessionBackend{orm: orm, table: table}
+}
+
+func NewSqlSessionStore(orm *fmorm.Orm, table string, keyPairs ...[]byte) *BackendSessionStore {
+	return NewBackendSessionStore(NewSqlSessionBackend(orm, table), keyPairs...)
+}
+
+func (b *SqlSessionBackend) Load(id string) ([]byte, bool, error) {
+	row := &sqlSessionRow{}
+	found, err := b.orm.Table(b.table).Where("id=? AND expires_at>?", id, time.Now().Unix()).SelectOne(row)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return row.Data, true, nil
+}
+
+func (b *SqlSessionBackend) update(row *sqlSessionRow) (int64, error) {
+	res, err := b.orm.Table(b.table).Columns("data", "expires_at").Where("id=?", row.ID).UpdateRow(row)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (b *SqlSessionBackend) Save(id string, data []byte, expiresAt time.Time) error {
+	row := &sqlSessionRow{ID: id, Data: data, ExpiresAt: expiresAt.Unix()}
+	n, err := b.update(row)
+	if err != nil || n != 0 {
+		return err
+	}
+	_, insertErr := b.orm.Table(b.table).InsertFull(row)
+	if insertErr == nil {
+		return nil
+	}
+	// the row may exist but not be affected by the update because nothing changed, or it was inserted concurrently.
+	// if the update still matches nothing, the insert failed for another reason and the session is not saved.
+	if n, err = b.update(row); err != nil || n != 0 {
+		return err
+	}
+	return insertErr
+}
+
+func (b *SqlSessionBackend) Delete(id string) error {
+	_, err := b.orm.Table(b.table).Where("id=?", id).Delete()
+	return err
+}
+
+func (b *SqlSessionBackend) DeleteExpired() (int64, error) {
+	res, err := b.orm.Table(b.table).Where("expires_at<=?", time.Now().Unix()).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
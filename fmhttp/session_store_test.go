@@ -0,0 +1,181 @@
+package fmhttp
+
+import (
+	"database/sql"
+	"github.com/go-farmyard/farmyard/fmorm"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSessionKeyPairs = [][]byte{[]byte("test-hash-key"), []byte("0123456789abcdef")}
+
+// testSessionStoreConformance checks the behaviors which all session stores must have
+func testSessionStoreConformance(t *testing.T, store sessions.Store) {
+	const name = "test-session"
+	roundTrip := func(cookies []*http.Cookie, fn func(s *sessions.Session, err error)) []*http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s, err := store.Get(r, name)
+		fn(s, err)
+		assert.NoError(t, s.Save(r, w))
+		return w.Result().Cookies()
+	}
+
+	t.Run("New", func(t *testing.T) {
+		roundTrip(nil, func(s *sessions.Session, err error) {
+			assert.NoError(t, err)
+			assert.True(t, s.IsNew)
+			assert.Empty(t, s.Values)
+		})
+	})
+
+	var cookies []*http.Cookie
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		cookies = roundTrip(nil, func(s *sessions.Session, err error) {
+			s.Values["str"] = "v"
+			s.Values["num"] = int64(42)
+		})
+		if assert.Len(t, cookies, 1) {
+			assert.EqualValues(t, name, cookies[0].Name)
+		}
+		roundTrip(cookies, func(s *sessions.Session, err error) {
+			assert.NoError(t, err)
+			assert.False(t, s.IsNew)
+			assert.EqualValues(t, "v", s.Values["str"])
+			assert.EqualValues(t, 42, s.Values["num"])
+		})
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := []*http.Cookie{{Name: name, Value: strings.ToUpper(cookies[0].Value)}}
+		roundTrip(tampered, func(s *sessions.Session, err error) {
+			assert.Error(t, err)
+			assert.Empty(t, s.Values)
+		})
+	})
+
+	t.Run("Destroy", func(t *testing.T) {
+		deleted := roundTrip(cookies, func(s *sessions.Session, err error) {
+			s.Options.MaxAge = -1
+		})
+		if assert.Len(t, deleted, 1) {
+			assert.True(t, deleted[0].MaxAge < 0)
+		}
+		if _, isCookieStore := store.(*sessions.CookieStore); isCookieStore {
+			// the old cookie is still valid if the client doesn't respect the deletion, it's the nature of cookie store
+			return
+		}
+		roundTrip(cookies, func(s *sessions.Session, err error) {
+			assert.True(t, s.IsNew)
+			assert.Empty(t, s.Values)
+		})
+	})
+}
+
+type testSqlSessionExecutor struct {
+	rows      map[string]sqlSessionRow
+	insertErr error
+}
+
+type testSqlResult int64
+
+func (r testSqlResult) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (r testSqlResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+func (e *testSqlSessionExecutor) Exec(query string, args ...any) (sql.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "UPDATE fm_session SET data=?,expires_at=? WHERE (id=?)"):
+		row, ok := e.rows[args[2].(string)]
+		if !ok {
+			return testSqlResult(0), nil
+		}
+		row.Data, row.ExpiresAt = args[0].([]byte), args[1].(int64)
+		e.rows[row.ID] = row
+		return testSqlResult(1), nil
+	case strings.HasPrefix(query, "INSERT INTO fm_session (id,data,expires_at) VALUES (?,?,?)"):
+		if e.insertErr != nil {
+			return nil, e.insertErr
+		}
+		e.rows[args[0].(string)] = sqlSessionRow{ID: args[0].(string), Data: args[1].([]byte), ExpiresAt: args[2].(int64)}
+		return testSqlResult(1), nil
+	case strings.HasPrefix(query, "DELETE FROM fm_session WHERE (id=?)"):
+		delete(e.rows, args[0].(string))
+		return testSqlResult(1), nil
+	}
+	return nil, sql.ErrConnDone
+}
+
+func (e *testSqlSessionExecutor) Select(_ any, _ string, _ ...any) error {
+	return sql.ErrConnDone
+}
+
+func (e *testSqlSessionExecutor) Get(dest any, query string, args ...any) error {
+	if !strings.HasPrefix(query, "SELECT * FROM fm_session WHERE (id=? AND expires_at>?)") {
+		return sql.ErrConnDone
+	}
+	row, ok := e.rows[args[0].(string)]
+	if !ok || row.ExpiresAt <= args[1].(int64) {
+		return sql.ErrNoRows
+	}
+	*dest.(*sqlSessionRow) = row
+	return nil
+}
+
+func TestSessionStores(t *testing.T) {
+	t.Run("Filesystem", func(t *testing.T) {
+		testSessionStoreConformance(t, sessions.NewFilesystemStore(t.TempDir(), testSessionKeyPairs...))
+	})
+	t.Run("Cookie", func(t *testing.T) {
+		testSessionStoreConformance(t, sessions.NewCookieStore(testSessionKeyPairs...))
+	})
+	t.Run("Memory", func(t *testing.T) {
+		testSessionStoreConformance(t, NewMemorySessionStore(testSessionKeyPairs...))
+	})
+	t.Run("Sql", func(t *testing.T) {
+		orm := fmorm.NewOrmWithExecutor(&fmorm.DialectNop{}, &testSqlSessionExecutor{rows: map[string]sqlSessionRow{}})
+		testSessionStoreConformance(t, NewSqlSessionStore(orm, "", testSessionKeyPairs...))
+	})
+}
+
+func TestSqlSessionBackendInsertError(t *testing.T) {
+	executor := &testSqlSessionExecutor{rows: map[string]sqlSessionRow{}, insertErr: sql.ErrConnDone}
+	b := NewSqlSessionBackend(fmorm.NewOrmWithExecutor(&fmorm.DialectNop{}, executor), "")
+	assert.ErrorIs(t, b.Save("s1", []byte("a"), time.Now().Add(time.Hour)), sql.ErrConnDone)
+	assert.Empty(t, executor.rows)
+
+	// the existing row is updated without inserting
+	executor.rows["s2"] = sqlSessionRow{ID: "s2"}
+	assert.NoError(t, b.Save("s2", []byte("b"), time.Now().Add(time.Hour)))
+	assert.EqualValues(t, "b", executor.rows["s2"].Data)
+}
+
+func TestMemorySessionBackendExpiry(t *testing.T) {
+	b := NewMemorySessionBackend()
+	assert.NoError(t, b.Save("expired", []byte("a"), time.Now().Add(-time.Second)))
+	_, found, _ := b.Load("expired")
+	assert.False(t, found)
+
+	b.lastSweep = time.Time{}
+	assert.NoError(t, b.Save("alive", []byte("b"), time.Now().Add(time.Hour)))
+	assert.EqualValues(t, 1, b.Len())
+
+	// the read-only traffic sweeps too
+	assert.NoError(t, b.Save("expired", []byte("a"), time.Now().Add(-time.Second)))
+	b.lastSweep = time.Time{}
+	_, found, _ = b.Load("alive")
+	assert.True(t, found)
+	assert.EqualValues(t, 1, b.Len())
+}
@@ -0,0 +1,250 @@
+package fmhttp
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testSessionRequest(t *testing.T, store sessions.Store, cookies []*http.Cookie, fn func(s *Session)) []*http.Cookie {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	lowSession, _ := store.Get(r, "test-session")
+	s := NewSession(lowSession)
+	fn(s)
+	assert.NoError(t, s.AutoSave(w, r))
+	return w.Result().Cookies()
+}
+
+func TestSessionRegenerate(t *testing.T) {
+	backend := NewMemorySessionBackend()
+	store := NewBackendSessionStore(backend, testSessionKeyPairs...)
+
+	var oldID, newID string
+	cookies := testSessionRequest(t, store, nil, func(s *Session) {
+		s.Set("k", "v")
+	})
+	newCookies := testSessionRequest(t, store, cookies, func(s *Session) {
+		oldID = s.session.ID
+		s.Regenerate()
+	})
+	testSessionRequest(t, store, newCookies, func(s *Session) {
+		newID = s.session.ID
+		assert.EqualValues(t, "v", s.GetString("k"))
+	})
+	assert.NotEmpty(t, oldID)
+	assert.NotEqualValues(t, oldID, newID)
+
+	_, found, _ := backend.Load(oldID)
+	assert.False(t, found)
+	testSessionRequest(t, store, cookies, func(s *Session) {
+		assert.Nil(t, s.Get("k"))
+	})
+}
+
+func TestSessionRegenerateMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	store := sessions.NewFilesystemStore(dir, testSessionKeyPairs...)
+
+	var oldID string
+	cookies := testSessionRequest(t, store, nil, func(s *Session) {
+		s.Set("k", "v")
+	})
+	newCookies := testSessionRequest(t, store, cookies, func(s *Session) {
+		oldID = s.session.ID
+		assert.NoError(t, os.Remove(filepath.Join(dir, "session_"+oldID)))
+		s.Regenerate()
+		s.Set("k2", "v2")
+	})
+	assert.Len(t, newCookies, 1)
+	testSessionRequest(t, store, newCookies, func(s *Session) {
+		assert.NotEqualValues(t, oldID, s.session.ID)
+		assert.EqualValues(t, "v", s.GetString("k"))
+		assert.EqualValues(t, "v2", s.GetString("k2"))
+	})
+
+	// the destroyed session only deletes the cookie if its file is missing
+	deleted := testSessionRequest(t, store, newCookies, func(s *Session) {
+		files, _ := filepath.Glob(filepath.Join(dir, "session_*"))
+		for _, f := range files {
+			assert.NoError(t, os.Remove(f))
+		}
+		s.Destroy()
+	})
+	assert.Len(t, deleted, 1)
+	assert.Negative(t, deleted[0].MaxAge)
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	store := NewMemorySessionStore(testSessionKeyPairs...)
+	cookies := testSessionRequest(t, store, nil, func(s *Session) {
+		s.enforceTimeouts(time.Hour, 24*time.Hour)
+		s.Set("k", "v")
+	})
+
+	tests := []struct {
+		name         string
+		createdAt    time.Duration
+		lastActiveAt time.Duration
+		alive        bool
+	}{
+		{name: "active", createdAt: -time.Hour, lastActiveAt: -time.Minute, alive: true},
+		{name: "idle", createdAt: -time.Hour, lastActiveAt: -2 * time.Hour, alive: false},
+		{name: "absolute", createdAt: -25 * time.Hour, lastActiveAt: -time.Minute, alive: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testSessionRequest(t, store, cookies, func(s *Session) {
+				s.session.Values[sessionKeyCreatedAt] = time.Now().Add(tt.createdAt).Unix()
+				s.session.Values[sessionKeyLastActiveAt] = time.Now().Add(tt.lastActiveAt).Unix()
+				s.enforceTimeouts(time.Hour, 24*time.Hour)
+				assert.EqualValues(t, tt.alive, s.Get("k") != nil)
+				// don't save the changes, every case starts with the same session
+				s.changed = false
+			})
+		})
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	backend := NewMemorySessionBackend()
+	oldOpt := &Options{SessionCookieSecureKey: "old-hash-key"}
+	newOpt := &Options{SessionCookieKeys: []SessionKeyPair{{HashKey: "new-hash-key", EncryptKey: "0123456789abcdef"}}, SessionCookieSecureKey: "old-hash-key"}
+
+	cookies := testSessionRequest(t, NewBackendSessionStore(backend, oldOpt.sessionKeyPairs()...), nil, func(s *Session) {
+		s.Set("k", "v")
+	})
+	rotatedStore := NewBackendSessionStore(backend, newOpt.sessionKeyPairs()...)
+	testSessionRequest(t, rotatedStore, cookies, func(s *Session) {
+		assert.EqualValues(t, "v", s.GetString("k"))
+	})
+
+	// once the old key is removed, the old cookies are rejected
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	_, err := NewBackendSessionStore(backend, []byte("new-hash-key"), nil).New(r, "test-session")
+	assert.Error(t, err)
+}
+
+func TestSessionFlashes(t *testing.T) {
+	store := NewMemorySessionStore(testSessionKeyPairs...)
+	cookies := testSessionRequest(t, store, nil, func(s *Session) {
+		s.AddFlash("error", "invalid password")
+		s.AddFlash("info", "try again")
+	})
+	cookies = testSessionRequest(t, store, cookies, func(s *Session) {
+		assert.EqualValues(t, []Flash{{"error", "invalid password"}, {"info", "try again"}}, s.Flashes())
+	})
+	testSessionRequest(t, store, cookies, func(s *Session) {
+		assert.Empty(t, s.Flashes())
+	})
+}
+
+func TestSessionFlashesRender(t *testing.T) {
+	hs := testHttpServer(&Options{
+		SessionCookieName:      "test-session",
+		SessionCookieSecureKey: "test-hash-key",
+		SessionStoreType:       SessionStoreMemory,
+		AssetsFS: fstest.MapFS{
+			"assets/template/page.tmpl":   {Data: []byte(`{{range flashes .}}{{.Message}};{{end}}`)},
+			"assets/template/plain.tmpl":  {Data: []byte(`plain`)},
+			"assets/template/broken.tmpl": {Data: []byte(`{{index (flashes .) 5}}`)},
+		},
+	})
+	r := NewRouter()
+	r.Get("/add", func(c *Context) Response {
+		c.Session().AddFlash("info", "saved")
+		return c.Respond("ok")
+	})
+	r.Get("/page", func(c *Context) Response {
+		c.Session().Set("visited", true)
+		return c.RespondTmpl("page.tmpl", nil)
+	})
+	r.Get("/plain", func(c *Context) Response {
+		return c.RespondTmpl("plain.tmpl", nil)
+	})
+	r.Get("/broken", func(c *Context) Response {
+		return c.RespondTmpl("broken.tmpl", nil)
+	})
+	handler := hs.wrapHandlers(r)
+	serve := func(target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		return testServeRequest(handler, httptest.NewRequest("GET", target, nil), cookies...)
+	}
+
+	// no session is created if the template does not show the flashes
+	assert.Empty(t, serve("/plain", nil).Result().Cookies())
+
+	cookies := serve("/add", nil).Result().Cookies()
+	// the flashes are kept if the rendering fails or if they are not shown
+	assert.EqualValues(t, http.StatusInternalServerError, serve("/broken", cookies).Code)
+	assert.EqualValues(t, "plain", serve("/plain", cookies).Body.String())
+	w := serve("/page", cookies)
+	assert.EqualValues(t, "saved;", w.Body.String())
+	// the session is saved once with the flashes removed
+	assert.Len(t, w.Result().Cookies(), 1)
+	assert.EqualValues(t, "", serve("/page", cookies).Body.String())
+}
+
+func TestSessionCookieDefaults(t *testing.T) {
+	for _, insecure := range []bool{false, true} {
+		hs := testHttpServer(&Options{
+			SessionCookieName:      "test-session",
+			SessionCookieSecureKey: "test-hash-key",
+			SessionStoreType:       SessionStoreMemory,
+			SessionCookieInsecure:  insecure,
+		})
+		var values map[any]any
+		handler := hs.wrapHandlers(func(c *Context) Response {
+			c.Session().Set("k", "v")
+			values = c.Session().session.Values
+			return c.Respond("ok")
+		})
+		cookies := testServe(handler, "GET", "/").Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.EqualValues(t, !insecure, cookies[0].Secure)
+			assert.True(t, cookies[0].HttpOnly)
+		}
+		// no timeout metadata without the timeouts
+		assert.EqualValues(t, map[any]any{"k": "v"}, values)
+	}
+}
+
+type testSessionUser struct {
+	ID    int64
+	Roles []string
+}
+
+func TestSessionTyped(t *testing.T) {
+	store := NewMemorySessionStore(testSessionKeyPairs...)
+	cookies := testSessionRequest(t, store, nil, func(s *Session) {
+		SetTyped(s, "user", testSessionUser{ID: 1, Roles: []string{"admin"}})
+		s.Set("plain", int64(2))
+	})
+	testSessionRequest(t, store, cookies, func(s *Session) {
+		user, ok := GetTyped[testSessionUser](s, "user")
+		assert.True(t, ok)
+		assert.EqualValues(t, testSessionUser{ID: 1, Roles: []string{"admin"}}, user)
+
+		_, ok = GetTyped[*testSessionUser](s, "user")
+		assert.False(t, ok)
+
+		assert.EqualValues(t, "github.com/go-farmyard/farmyard/fmhttp:fmhttp.testSessionUser", sessionTypeName(reflect.TypeFor[testSessionUser]()))
+		assert.EqualValues(t, "github.com/go-farmyard/farmyard/fmhttp:*fmhttp.testSessionUser", sessionTypeName(reflect.TypeFor[*testSessionUser]()))
+		assert.EqualValues(t, "github.com/go-farmyard/farmyard/fmhttp:map[string][]*fmhttp.testSessionUser", sessionTypeName(reflect.TypeFor[map[string][]*testSessionUser]()))
+		assert.EqualValues(t, "[]string", sessionTypeName(reflect.TypeFor[[]string]()))
+
+		plain, ok := GetTyped[int64](s, "plain")
+		assert.True(t, ok)
+		assert.EqualValues(t, 2, plain)
+	})
+}
@@ -0,0 +1,127 @@
+package fmhttp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const sessionKeyFlashes = "__fm_flashes"
+
+// TmplDataKeyFlashes is the template data key of the flash messages, they are read by the "flashes" template function
+// and consumed after RespondTmpl renders them
+const TmplDataKeyFlashes = "Flashes"
+
+type Flash struct {
+	Kind    string
+	Message string
+}
+
+// sessionTypedValue holds a gob-encoded value, so the custom types don't need to be registered for the session stores
+type sessionTypedValue struct {
+	Type string
+	Data []byte
+}
+
+func init() {
+	gob.Register([]Flash{})
+	gob.Register(sessionTypedValue{})
+}
+
+// AddFlash adds a message which is shown once, eg: AddFlash("error", "invalid password")
+func (ws *Session) AddFlash(kind, msg string) {
+	flashes, _ := ws.session.Values[sessionKeyFlashes].([]Flash)
+	ws.Set(sessionKeyFlashes, append(flashes, Flash{Kind: kind, Message: msg}))
+}
+
+// Flashes returns the flash messages and removes them from the session
+func (ws *Session) Flashes() []Flash {
+	flashes, _ := ws.session.Values[sessionKeyFlashes].([]Flash)
+	if len(flashes) != 0 {
+		ws.Remove(sessionKeyFlashes)
+	}
+	return flashes
+}
+
+// tmplFlashes loads the flash messages when the template calls "flashes", so the pages which don't show them
+// don't load the session. RespondTmpl removes the loaded flashes after the template is rendered.
+type tmplFlashes struct {
+	req     *Context
+	loaded  bool
+	flashes []Flash
+}
+
+func (f *tmplFlashes) load() []Flash {
+	if !f.loaded {
+		f.loaded = true
+		if f.req.hasSession() {
+			f.flashes, _ = f.req.Session().session.Values[sessionKeyFlashes].([]Flash)
+		}
+	}
+	return f.flashes
+}
+
+// tmplFuncFlashes returns the flash messages of the template data: {{range flashes .}}{{.Message}}{{end}}
+func tmplFuncFlashes(data map[string]any) []Flash {
+	switch v := data[TmplDataKeyFlashes].(type) {
+	case *tmplFlashes:
+		return v.load()
+	case []Flash:
+		return v
+	}
+	return nil
+}
+
+// removeShownFlashes removes the flash messages and saves the session again, because the session has been saved before responding.
+// The cookie of the previous saving is replaced.
+func (c *Context) removeShownFlashes(w http.ResponseWriter) error {
+	c.session.Remove(sessionKeyFlashes)
+	h := w.Header()
+	h["Set-Cookie"] = slices.DeleteFunc(slices.Clone(h["Set-Cookie"]), func(cookie string) bool {
+		return strings.HasPrefix(cookie, c.HttpServer.sessionCookieName+"=")
+	})
+	return c.session.AutoSave(w, c.Request)
+}
+
+// sessionTypeName identifies the type of a typed value, the package path is included because the names may be the same.
+// The unnamed types (eg: *pkg.T, []pkg.T) are qualified by the package path of their element types.
+func sessionTypeName(t reflect.Type) string {
+	named := t
+	for named.Name() == "" {
+		if k := named.Kind(); k != reflect.Pointer && k != reflect.Slice && k != reflect.Array && k != reflect.Map && k != reflect.Chan {
+			break
+		}
+		named = named.Elem()
+	}
+	if named.PkgPath() == "" {
+		return t.String()
+	}
+	return named.PkgPath() + ":" + t.String()
+}
+
+// GetTyped returns the value set by SetTyped (or Set), ok is false if the value doesn't exist or is not a T
+func GetTyped[T any](ws *Session, key string) (ret T, ok bool) {
+	switch v := ws.session.Values[key].(type) {
+	case sessionTypedValue:
+		if v.Type != sessionTypeName(reflect.TypeOf(&ret).Elem()) {
+			return ret, false
+		}
+		err := gob.NewDecoder(bytes.NewReader(v.Data)).Decode(&ret)
+		return ret, err == nil
+	case T:
+		return v, true
+	}
+	return ret, false
+}
+
+// SetTyped sets a value of any gob-encodable type, the type doesn't need to be registered by gob.Register
+func SetTyped[T any](ws *Session, key string, val T) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&val)
+	fmutil.MustNoError(err, "can not encode session value %q", key)
+	ws.Set(key, sessionTypedValue{Type: sessionTypeName(reflect.TypeOf(&val).Elem()), Data: buf.Bytes()})
+}
@@ -0,0 +1,61 @@
+package fmhttp
+
+import (
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type SpaOptions struct {
+	// Prefix is the URL prefix of the application, default is "/"
+	Prefix string
+	// Root is the directory of the application in AssetsWebRoot, default is the AssetsWebRoot itself
+	Root string
+	// Index is the file responded for the client-side routes, default is "index.html"
+	Index string
+}
+
+// SpaHandler serves a single-page application: the existing files are served as assets (directories use their index.html),
+// the other GET paths without extensions fall back to the Index file, so the client-side router could handle them.
+// The paths with extensions (eg: "/app/missing.js") are still 404.
+//
+// It is usually mounted by a wildcard route, the other routes on the same router take precedence:
+//
+//	r.Get("/api/users", listUsers)
+//	r.Get("/**", hs.SpaHandler())
+func (hs *HttpServer) SpaHandler(opts ...SpaOptions) RequestHandlerFunc {
+	opt := fmutil.DefZero(opts)
+	prefix := fmutil.IfZero(opt.Prefix, "/")
+	index := path.Join(opt.Root, fmutil.IfZero(opt.Index, assetIndexFile))
+
+	return func(c *Context) Response {
+		reqPath, ok := strings.CutPrefix(c.Request.URL.Path, prefix)
+		if !ok && c.Request.URL.Path+"/" != prefix {
+			return c.Respond(NewHttpError(http.StatusNotFound, "not found: "+c.Request.URL.Path))
+		}
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			return c.Respond(NewHttpError(http.StatusMethodNotAllowed, "method not allowed: "+c.Request.Method))
+		}
+		if !ok {
+			// eg: "/app" for the prefix "/app/", the relative URLs of the application only work under the prefix
+			location := prefix
+			if c.Request.URL.RawQuery != "" {
+				location += "?" + c.Request.URL.RawQuery
+			}
+			return c.Respond(RedirectPermanent(location))
+		}
+
+		name := path.Join(opt.Root, reqPath)
+		if _, hashed := hs.assets.resolve(name); hashed {
+			return hs.respondAsset(c, name)
+		}
+		if _, _, err := hs.assets.assetStat(name); err == nil {
+			return hs.respondAsset(c, name)
+		}
+		if path.Ext(reqPath) != "" {
+			return c.Respond(NewHttpError(http.StatusNotFound, "no static file: "+c.Request.URL.Path))
+		}
+		return hs.respondAsset(c, index)
+	}
+}
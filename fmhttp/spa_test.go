@@ -0,0 +1,42 @@
+package fmhttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSpaHandler(t *testing.T) {
+	hs := testHttpServer(&Options{AssetsFS: fstest.MapFS{
+		"assets/web/app/index.html":      {Data: []byte(`<div id="app"></div>`)},
+		"assets/web/app/js/main.js":      {Data: []byte(`main()`)},
+		"assets/web/app/docs/index.html": {Data: []byte(`docs`)},
+	}})
+	r := NewRouter()
+	r.Route("/app", func(r Router) {
+		r.Get("/api/users", func(c *Context) Response {
+			return c.RespondJson([]string{"a"})
+		})
+		r.Get("/**", hs.SpaHandler(SpaOptions{Prefix: "/app/", Root: "app"}))
+	})
+	handler := hs.wrapHandlers(r)
+
+	assert.EqualValues(t, `["a"]`, testServe(handler, "GET", "/app/api/users").Body.String())
+	assert.EqualValues(t, `main()`, testServe(handler, "GET", "/app/js/main.js").Body.String())
+	assert.EqualValues(t, `docs`, testServe(handler, "GET", "/app/docs/").Body.String())
+
+	w := testServe(handler, "GET", "/app/users/1/edit")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, `<div id="app"></div>`, w.Body.String())
+	assert.EqualValues(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	assert.EqualValues(t, `<div id="app"></div>`, testServe(handler, "GET", "/app/").Body.String())
+	w = testServe(handler, "GET", "/app?tab=1")
+	assert.EqualValues(t, http.StatusPermanentRedirect, w.Code)
+	assert.EqualValues(t, "/app/?tab=1", w.Header().Get("Location"))
+	assert.EqualValues(t, http.StatusNotFound, testServe(handler, "GET", "/app/js/missing.js").Code)
+	// only GET is routed to the application
+	assert.EqualValues(t, http.StatusNotFound, testServe(handler, "POST", "/app/users").Code)
+}
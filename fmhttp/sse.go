@@ -0,0 +1,178 @@
+package fmhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sseDefaultHeartbeatInterval = 15 * time.Second
+
+type SSEOptions struct {
+	// HeartbeatInterval is the interval of the comment lines to keep the connection alive, default is 15 seconds, -1 disables it
+	HeartbeatInterval time.Duration
+	// Retry is the reconnection time sent to the client at the beginning, it is not sent if it is zero
+	Retry time.Duration
+}
+
+// SSEEvent is a Server-Sent Event, the Data is sent as it is if it is a string or []byte, otherwise it is encoded as JSON
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  any
+	Retry time.Duration
+}
+
+// SSEStream writes the events to the client, it is safe for concurrent use
+type SSEStream struct {
+	c           *Context
+	w           http.ResponseWriter
+	mu          sync.Mutex
+	lastEventID string
+}
+
+// LastEventID returns the Last-Event-ID sent by a reconnecting client, the stream should resume after it
+func (s *SSEStream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client is disconnected
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.c.Done()
+}
+
+func (s *SSEStream) write(msg string) error {
+	if err := s.c.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Send writes an event and flushes it, it returns an error if the client is disconnected
+func (s *SSEStream) Send(event SSEEvent) error {
+	var data string
+	switch v := event.Data.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	case nil:
+	default:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = string(buf)
+	}
+
+	sb := strings.Builder{}
+	// the fields can't contain newlines, the multi-line data is sent as multiple "data" fields
+	if event.ID != "" {
+		sb.WriteString("id: " + strings.ReplaceAll(event.ID, "\n", "") + "\n")
+	}
+	if event.Event != "" {
+		sb.WriteString("event: " + strings.ReplaceAll(event.Event, "\n", "") + "\n")
+	}
+	if event.Retry > 0 {
+		sb.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	if event.Data != nil {
+		for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+			sb.WriteString("data: " + line + "\n")
+		}
+	}
+	sb.WriteString("\n")
+	return s.write(sb.String())
+}
+
+// SendData sends an event with only the data
+func (s *SSEStream) SendData(data any) error {
+	return s.Send(SSEEvent{Data: data})
+}
+
+// Comment sends a comment line, which is ignored by the clients
+func (s *SSEStream) Comment(text string) error {
+	return s.write(": " + strings.ReplaceAll(text, "\n", " ") + "\n\n")
+}
+
+type responderSSE struct {
+	req *Context
+	fn  func(stream *SSEStream) error
+	opt SSEOptions
+}
+
+func (r responderSSE) respondWithStatus(w http.ResponseWriter, statusCode int) (int64, error) {
+	h := w.Header()
+	h.Set(headerContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // disable the buffering of nginx
+	h.Del("Content-Length")
+	w.WriteHeader(fmutil.IfZero(statusCode, http.StatusOK))
+
+	stream := &SSEStream{c: r.req, w: w, lastEventID: r.req.Request.Header.Get("Last-Event-ID")}
+	var err error
+	if r.opt.Retry > 0 {
+		err = stream.write("retry: " + strconv.FormatInt(r.opt.Retry.Milliseconds(), 10) + "\n\n")
+	} else {
+		err = stream.write(": connected\n\n")
+	}
+	if err != nil {
+		return r.req.ResponseWriter.written, err
+	}
+
+	stopHeartbeat := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		interval := fmutil.IfZero(r.opt.HeartbeatInterval, sseDefaultHeartbeatInterval)
+		if interval < 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if stream.Comment("ping") != nil {
+					return
+				}
+			case <-stopHeartbeat:
+				return
+			case <-stream.Done():
+				return
+			}
+		}
+	}()
+
+	err = r.fn(stream)
+	close(stopHeartbeat)
+	<-heartbeatDone
+	// the client disconnection is the normal end of a stream
+	if errors.Is(err, r.req.Err()) {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("sse stream error: %w", err)
+	}
+	return r.req.ResponseWriter.written, err
+}
+
+// RespondSSE responds a Server-Sent Events stream, the fn sends the events until the client is disconnected (stream.Done()).
+// The response is flushed after each event, so it bypasses the buffering of the compression middleware.
+func (c *Context) RespondSSE(fn func(stream *SSEStream) error, opts ...SSEOptions) *ResponseCommon {
+	return c.Respond(responderSSE{req: c, fn: fn, opt: fmutil.DefZero(opts)})
+}
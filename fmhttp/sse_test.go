@@ -0,0 +1,76 @@
+package fmhttp
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRespondSSE(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Use(Compress())
+	r.Get("/events", func(c *Context) Response {
+		return c.RespondSSE(func(stream *SSEStream) error {
+			if err := stream.Send(SSEEvent{ID: "1", Event: "greet", Data: "hello\nworld"}); err != nil {
+				return err
+			}
+			if err := stream.Send(SSEEvent{ID: "2", Data: map[string]any{"resumed": stream.LastEventID()}}); err != nil {
+				return err
+			}
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}, SSEOptions{HeartbeatInterval: 10 * time.Millisecond, Retry: 3 * time.Second})
+	})
+	r.Get("/forever", func(c *Context) Response {
+		return c.RespondSSE(func(stream *SSEStream) error {
+			for i := 0; ; i++ {
+				select {
+				case <-stream.Done():
+					return stream.c.Err()
+				case <-time.After(5 * time.Millisecond):
+					if err := stream.SendData(i); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	})
+	handler := hs.wrapHandlers(r)
+
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Last-Event-ID", "7")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.EqualValues(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.True(t, w.Flushed)
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, "retry: 3000\n\nid: 1\nevent: greet\ndata: hello\ndata: world\n\nid: 2\ndata: {\"resumed\":\"7\"}\n\n"), body)
+	assert.Contains(t, body, ": ping\n\n")
+
+	// the stream stops when the client is disconnected
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, "GET", srv.URL+"/forever", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		if line == "data: 2\n" {
+			break
+		}
+	}
+	cancel()
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,59 @@
+package fmhttp
+
+import (
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io"
+	"net/http"
+)
+
+// streamWriter writes the status code at the first write or flush, so the handler could still respond an error before it
+type streamWriter struct {
+	w          http.ResponseWriter
+	statusCode int
+	started    bool
+}
+
+func (sw *streamWriter) start() {
+	if !sw.started {
+		sw.started = true
+		sw.w.Header().Del("Content-Length")
+		sw.w.WriteHeader(fmutil.IfZero(sw.statusCode, http.StatusOK))
+	}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.start()
+	return sw.w.Write(p)
+}
+
+func (sw *streamWriter) flush() {
+	sw.start()
+	_ = http.NewResponseController(sw.w).Flush()
+}
+
+type responderStream struct {
+	req *Context
+	fn  func(w io.Writer, flush func()) error
+}
+
+func (r responderStream) respondWithStatus(w http.ResponseWriter, statusCode int) (int64, error) {
+	sw := &streamWriter{w: w, statusCode: statusCode}
+	err := r.fn(sw, sw.flush)
+	if err != nil && !sw.started {
+		return r.req.HttpServer.respondError(r.req, w, statusCode, err)
+	}
+	sw.start()
+	if err != nil {
+		// the response is truncated, the client could only detect it by the format (eg: the last line of NDJSON)
+		err = fmt.Errorf("stream error: %w", err)
+	}
+	return r.req.ResponseWriter.written, err
+}
+
+// RespondStream responds a body written by fn without buffering it, eg: a long-running NDJSON or CSV export.
+// The flush sends the written data to the client immediately, the fn should stop when the client is disconnected (c.Done()).
+// If fn returns an error before writing anything, the error is responded like the other errors.
+func (c *Context) RespondStream(fn func(w io.Writer, flush func()) error) *ResponseCommon {
+	return c.Respond(responderStream{req: c, fn: fn})
+}
@@ -0,0 +1,92 @@
+package fmhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRespondStream(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	next := make(chan struct{})
+	r.Get("/export", func(c *Context) Response {
+		resp := c.RespondStream(func(w io.Writer, flush func()) error {
+			for i := 0; i < 3; i++ {
+				if _, err := fmt.Fprintf(w, "{\"n\":%d}\n", i); err != nil {
+					return err
+				}
+				flush()
+				<-next
+			}
+			return nil
+		})
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+		return resp
+	})
+	r.Get("/fail", func(c *Context) Response {
+		return c.RespondStream(func(w io.Writer, flush func()) error {
+			return NewHttpError(http.StatusNotFound, "no such export")
+		})
+	})
+	r.Get("/controller", func(c *Context) Response {
+		rc := http.NewResponseController(c.ResponseWriter)
+		assert.NoError(t, rc.SetWriteDeadline(time.Now().Add(time.Minute)))
+		n, err := io.Copy(c.ResponseWriter, strings.NewReader("copied"))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 6, n)
+		return nil
+	})
+	srv := httptest.NewServer(hs.wrapHandlers(r))
+	defer srv.Close()
+
+	// each line is received before the next one is written
+	resp, err := http.Get(srv.URL + "/export")
+	assert.NoError(t, err)
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+	assert.EqualValues(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.EqualValues(t, []string{"chunked"}, resp.TransferEncoding)
+	reader := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.EqualValues(t, fmt.Sprintf("{\"n\":%d}\n", i), line)
+		next <- struct{}{}
+	}
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(srv.URL + "/fail")
+	assert.NoError(t, err)
+	assert.EqualValues(t, http.StatusNotFound, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "no such export")
+
+	resp, err = http.Get(srv.URL + "/controller")
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.EqualValues(t, "copied", string(body))
+}
+
+func TestRespondStreamError(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Get("/partial", func(c *Context) Response {
+		return c.RespondStream(func(w io.Writer, flush func()) error {
+			_, _ = io.WriteString(w, "a,b\n")
+			return errors.New("db closed")
+		})
+	})
+	w := httptest.NewRecorder()
+	hs.wrapHandlers(r).ServeHTTP(w, httptest.NewRequest("GET", "/partial", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "a,b\n", w.Body.String())
+}
@@ -1,40 +1,76 @@
 package fmhttp
 
 import (
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"text/template/parse"
+	"time"
 )
 
+const tmplFuncLayout = "layout"
+
 type TemplateRender struct {
 	DevMode    bool
 	TemplateFS fs.FS
 
+	// AssetsUrlPrefix is used by the "asset" template function, default is "/"
+	AssetsUrlPrefix string
+	// Assets fingerprints the paths returned by the "asset" template function
+	Assets *AssetPipeline
+
+	// WatchInterval is the interval of checking the changed template files in DevMode, default is 1 second
+	WatchInterval time.Duration
+
+	funcMap template.FuncMap
+
 	cachedTemplatesMu sync.RWMutex
 	cachedTemplates   map[string]*template.Template
+	// the files used by each cached template, to invalidate the template when any of them is changed
+	cachedTemplateFiles map[string][]string
+	// cachedTemplatesGen is increased by every invalidation, a template parsed before it is not cached
+	cachedTemplatesGen uint64
+
+	watcher templateWatcher
 }
 
 func NewTemplateRender(templateFS fs.FS) *TemplateRender {
-	return &TemplateRender{
-		TemplateFS:      templateFS,
-		cachedTemplates: map[string]*template.Template{},
+	r := &TemplateRender{
+		TemplateFS:          templateFS,
+		funcMap:             template.FuncMap{},
+		cachedTemplates:     map[string]*template.Template{},
+		cachedTemplateFiles: map[string][]string{},
 	}
+	r.Funcs(builtinTmplFuncs(r))
+	return r
 }
 
-func (r *TemplateRender) parseTemplateOne(name string) (*template.Template, error) {
-	f, err := r.TemplateFS.Open(name)
-	if err != nil {
-		return nil, err
+// Funcs adds the functions to the templates, the existing functions with the same names are replaced.
+// It should be called before rendering, the cached templates are cleared.
+func (r *TemplateRender) Funcs(funcMap template.FuncMap) *TemplateRender {
+	r.cachedTemplatesMu.Lock()
+	defer r.cachedTemplatesMu.Unlock()
+	for k, v := range funcMap {
+		r.funcMap[k] = v
 	}
-	tmplBytes, err := io.ReadAll(f)
+	r.cachedTemplates = map[string]*template.Template{}
+	r.cachedTemplateFiles = map[string][]string{}
+	r.cachedTemplatesGen++
+	return r
+}
+
+func (r *TemplateRender) parseTemplateOne(name string) (*template.Template, error) {
+	tmplBytes, err := fs.ReadFile(r.TemplateFS, name)
 	if err != nil {
 		return nil, err
 	}
 
-	t := template.New(name)
+	t := template.New(name).Funcs(r.funcMap)
 	_, err = t.Parse(string(tmplBytes))
 	if err != nil {
 		return nil, err
@@ -42,6 +78,72 @@ func (r *TemplateRender) parseTemplateOne(name string) (*template.Template, erro
 	return t, nil
 }
 
+// walkTemplateNodes visits the nodes recursively, including the nodes inside if/range/with
+func walkTemplateNodes(node parse.Node, fn func(node parse.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, sub := range n.Nodes {
+				walkTemplateNodes(sub, fn)
+			}
+		}
+	case *parse.IfNode:
+		walkTemplateNodes(n.List, fn)
+		walkTemplateNodes(n.ElseList, fn)
+	case *parse.RangeNode:
+		walkTemplateNodes(n.List, fn)
+		walkTemplateNodes(n.ElseList, fn)
+	case *parse.WithNode:
+		walkTemplateNodes(n.List, fn)
+		walkTemplateNodes(n.ElseList, fn)
+	}
+}
+
+// templateLayout returns the layout declared by {{layout "name.tmpl"}} at the top level of the template
+func templateLayout(tmpl *template.Template) string {
+	if tmpl.Tree == nil {
+		return ""
+	}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		actionNode, ok := node.(*parse.ActionNode)
+		if !ok || len(actionNode.Pipe.Cmds) != 1 {
+			continue
+		}
+		args := actionNode.Pipe.Cmds[0].Args
+		if len(args) != 2 {
+			continue
+		}
+		if identNode, ok := args[0].(*parse.IdentifierNode); ok && identNode.Ident == tmplFuncLayout {
+			if strNode, ok := args[1].(*parse.StringNode); ok {
+				return strNode.Text
+			}
+		}
+	}
+	return ""
+}
+
+// templateDependencies returns the template files used by {{template "name.tmpl"}} in all the defined templates, and the layout
+func templateDependencies(tmpl *template.Template) (deps []string) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkTemplateNodes(t.Tree.Root, func(node parse.Node) {
+			if tmplNode, ok := node.(*parse.TemplateNode); ok && strings.HasSuffix(tmplNode.Name, ".tmpl") {
+				deps = append(deps, tmplNode.Name)
+			}
+		})
+	}
+	if layout := templateLayout(tmpl); layout != "" {
+		deps = append(deps, layout)
+	}
+	return deps
+}
+
 func (r *TemplateRender) parseTemplate(parsedMap map[string]*template.Template, name string) error {
 	tmpl, err := r.parseTemplateOne(name)
 	if err != nil {
@@ -49,53 +151,105 @@ func (r *TemplateRender) parseTemplate(parsedMap map[string]*template.Template,
 	}
 
 	parsedMap[name] = tmpl
-	for _, node := range tmpl.Tree.Root.Nodes {
-		if tmplNode, ok := node.(*parse.TemplateNode); ok {
-			if _, ok := parsedMap[tmplNode.Name]; ok {
-				continue
-			}
-			if !strings.HasSuffix(tmplNode.Name, ".tmpl") {
+	for _, dep := range templateDependencies(tmpl) {
+		if _, ok := parsedMap[dep]; ok {
+			continue
+		}
+		err = r.parseTemplate(parsedMap, dep)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateLayoutChain returns the layouts from the outermost one to the template itself
+func templateLayoutChain(parsedMap map[string]*template.Template, tmplName string) ([]string, error) {
+	chain := []string{tmplName}
+	for layout := templateLayout(parsedMap[tmplName]); layout != ""; layout = templateLayout(parsedMap[layout]) {
+		if slices.Contains(chain, layout) {
+			return nil, fmt.Errorf("template %s has a layout cycle: %s", tmplName, layout)
+		}
+		chain = append([]string{layout}, chain...)
+	}
+	return chain, nil
+}
+
+// assembleTemplate puts all parsed templates into one set, the entry is the outermost layout.
+// The layouts are added after the partials from the outermost one, so the blocks defined in a page override its layout's.
+func (r *TemplateRender) assembleTemplate(parsedMap map[string]*template.Template, tmplName string) (*template.Template, error) {
+	chain, err := templateLayoutChain(parsedMap, tmplName)
+	if err != nil {
+		return nil, err
+	}
+
+	t := template.New(chain[0]).Funcs(r.funcMap)
+	addTrees := func(parsed *template.Template) error {
+		// the templates defined by the files are added in a stable order, the later ones replace the earlier ones
+		parsedTmpls := parsed.Templates()
+		slices.SortFunc(parsedTmpls, func(a, b *template.Template) int { return strings.Compare(a.Name(), b.Name()) })
+		for _, pt := range parsedTmpls {
+			if pt.Tree == nil {
 				continue
 			}
-			err = r.parseTemplate(parsedMap, tmplNode.Name)
-			if err != nil {
+			if _, err := t.AddParseTree(pt.Name(), pt.Tree); err != nil {
 				return err
 			}
 		}
+		return nil
 	}
-	return nil
+	// the partials are added in the sorted name order, then the layout chain
+	for _, parsedName := range slices.Sorted(maps.Keys(parsedMap)) {
+		if !slices.Contains(chain, parsedName) {
+			if err = addTrees(parsedMap[parsedName]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range chain {
+		if err = addTrees(parsedMap[name]); err != nil {
+			return nil, err
+		}
+	}
+	// AddParseTree creates a new html template for the entry name, t itself is not updated
+	return t.Lookup(chain[0]), nil
 }
 
 func (r *TemplateRender) loadTemplate(tmplName string) (*template.Template, error) {
-	if !r.DevMode {
-		r.cachedTemplatesMu.RLock()
-		t, ok := r.cachedTemplates[tmplName]
-		r.cachedTemplatesMu.RUnlock()
-		if ok {
-			return t, nil
-		}
+	if r.DevMode {
+		r.invalidateChangedTemplates()
 	}
-	r.cachedTemplatesMu.Lock()
-	defer r.cachedTemplatesMu.Unlock()
 
+	r.cachedTemplatesMu.RLock()
 	t, ok := r.cachedTemplates[tmplName]
-	if r.DevMode || !ok {
-		parsedMap := map[string]*template.Template{}
-		err := r.parseTemplate(parsedMap, tmplName)
-		if err != nil {
-			return nil, err
-		}
+	gen := r.cachedTemplatesGen
+	r.cachedTemplatesMu.RUnlock()
+	if ok {
+		return t, nil
+	}
 
-		t = parsedMap[tmplName]
-		for parsedName, parsedTmpl := range parsedMap {
-			_, err = t.AddParseTree(parsedName, parsedTmpl.Tree)
-			if err != nil {
-				return nil, err
-			}
-		}
+	// parse without the lock, other templates could be rendered concurrently
+	parsedMap := map[string]*template.Template{}
+	err := r.parseTemplate(parsedMap, tmplName)
+	if err != nil {
+		return nil, err
+	}
+	t, err = r.assembleTemplate(parsedMap, tmplName)
+	if err != nil {
+		return nil, err
+	}
 
-		r.cachedTemplates[tmplName] = t
+	r.cachedTemplatesMu.Lock()
+	defer r.cachedTemplatesMu.Unlock()
+	if cached, ok := r.cachedTemplates[tmplName]; ok {
+		return cached, nil
+	}
+	if gen != r.cachedTemplatesGen {
+		// the files were changed during the parsing, the template may be stale, parse it again next time
+		return t, nil
 	}
+	r.cachedTemplates[tmplName] = t
+	r.cachedTemplateFiles[tmplName] = slices.Collect(maps.Keys(parsedMap))
 	return t, nil
 }
 
@@ -0,0 +1,134 @@
+package fmhttp
+
+import (
+	"bytes"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the buffers larger than this are not put back to the pool, to avoid holding too much memory by a few large pages
+const renderBufferMaxPooledSize = 1 << 20
+
+var renderBufferPool = sync.Pool{New: func() any { return &bytes.Buffer{} }}
+
+func getRenderBuffer() *bytes.Buffer {
+	return renderBufferPool.Get().(*bytes.Buffer)
+}
+
+func putRenderBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > renderBufferMaxPooledSize {
+		return
+	}
+	buf.Reset()
+	renderBufferPool.Put(buf)
+}
+
+// TmplDataKeyStatusCode is the template data key of the status code for the error template
+const TmplDataKeyStatusCode = "StatusCode"
+
+// respondTmplError responds a 500 page for a failed template rendering, nothing has been written to the response yet.
+// The rendering error itself is returned by the responder and logged by the caller.
+// In DevMode, it shows the error with the template files and the source lines, otherwise the ErrorTemplate is used if it is set.
+func (hs *HttpServer) respondTmplError(w http.ResponseWriter, tmplName string, renderErr error) {
+	buf := getRenderBuffer()
+	defer putRenderBuffer(buf)
+
+	var err error
+	if hs.devMode {
+		err = tmplDevErrorPage.Execute(buf, hs.tmplRender.errorDetail(tmplName, renderErr))
+	} else if hs.errorTemplate != "" && hs.errorTemplate != tmplName {
+		err = hs.tmplRender.Render(buf, hs.errorTemplate, map[string]any{
+			TmplDataKeyStatusCode: http.StatusInternalServerError,
+			TmplDataKeyError:      &HttpError{Status: http.StatusInternalServerError, Title: http.StatusText(http.StatusInternalServerError)},
+		})
+	} else {
+		buf.WriteString("internal error (render template error)")
+		w.Header().Set(headerContentType, "text/plain; charset=utf-8")
+	}
+	if err != nil {
+		fmlog.Errorf("fmhttp: failed to render the error page for template %s, err: %v", tmplName, err)
+		http.Error(w, "internal error (render template error)", http.StatusInternalServerError)
+		return
+	}
+
+	if len(w.Header()[headerContentType]) == 0 {
+		w.Header().Set(headerContentType, "text/html; charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = buf.WriteTo(w)
+}
+
+type tmplErrorSourceLine struct {
+	Num     int
+	Text    string
+	IsError bool
+}
+
+type tmplErrorDetail struct {
+	Template string
+	Error    string
+	// Files are the templates used by the failed template, the page, its layouts and partials
+	Files []string
+	// SourceFile and SourceLines are the lines around the error position
+	SourceFile  string
+	SourceLines []tmplErrorSourceLine
+}
+
+// the error position in the messages of text/template and html/template: "template: page.tmpl:12:5: executing ..."
+var tmplErrorPosRegexp = regexp.MustCompile(`template: ([^:\s]+):(\d+):`)
+
+func (r *TemplateRender) errorDetail(tmplName string, renderErr error) *tmplErrorDetail {
+	detail := &tmplErrorDetail{Template: tmplName, Error: renderErr.Error()}
+
+	r.cachedTemplatesMu.RLock()
+	detail.Files = slices.Clone(r.cachedTemplateFiles[tmplName])
+	r.cachedTemplatesMu.RUnlock()
+	slices.Sort(detail.Files)
+
+	// the last position is the innermost template which has the error
+	matches := tmplErrorPosRegexp.FindAllStringSubmatch(detail.Error, -1)
+	if len(matches) == 0 {
+		return detail
+	}
+	match := matches[len(matches)-1]
+	errLine, _ := strconv.Atoi(match[2])
+	src, err := fs.ReadFile(r.TemplateFS, match[1])
+	if err != nil {
+		return detail
+	}
+	detail.SourceFile = match[1]
+	lines := strings.Split(string(src), "\n")
+	for i := max(errLine-4, 0); i < min(errLine+3, len(lines)); i++ {
+		detail.SourceLines = append(detail.SourceLines, tmplErrorSourceLine{Num: i + 1, Text: lines[i], IsError: i+1 == errLine})
+	}
+	return detail
+}
+
+var tmplDevErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Template Error: {{.Template}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+.error-line { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Failed to render template {{.Template}}</h1>
+<pre>{{.Error}}</pre>
+{{if .SourceLines}}<h2>{{.SourceFile}}</h2>
+<pre>{{range .SourceLines}}<span{{if .IsError}} class="error-line"{{end}}>{{printf "%4d" .Num}}  {{.Text}}</span>
+{{end}}</pre>{{end}}
+{{if .Files}}<h2>Templates</h2>
+<ul>{{range .Files}}<li>{{.}}</li>{{end}}</ul>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,81 @@
+package fmhttp
+
+import (
+	"encoding/json"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"html/template"
+	"strings"
+	"time"
+)
+
+const tmplDefaultDateLayout = "2006-01-02"
+
+func builtinTmplFuncs(r *TemplateRender) template.FuncMap {
+	return template.FuncMap{
+		// layout is handled when loading the templates, it outputs nothing
+		tmplFuncLayout: func(string) string { return "" },
+
+		"csrfToken": tmplFuncCsrfToken,
+		"csrfField": tmplFuncCsrfField,
+		"flashes":   tmplFuncFlashes,
+
+		"url":        tmplFuncUrl,
+		"asset":      r.assetUrl,
+		"formatDate": tmplFuncFormatDate,
+		"json":       tmplFuncJson,
+		"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+		"safeURL":    func(s string) template.URL { return template.URL(s) },
+	}
+}
+
+// tmplFuncUrl builds a URL with query parameters: {{url "/search" "q" .Keyword "page" 2}}
+func tmplFuncUrl(base string, kvs ...any) string {
+	if len(kvs) == 0 {
+		return base
+	}
+	fmutil.MustTrue(len(kvs)%2 == 0, "url parameters must be key-value pairs")
+	params := fmutil.Map{}
+	for i := 0; i < len(kvs); i += 2 {
+		params[fmutil.AsString(kvs[i])] = kvs[i+1]
+	}
+	return fmutil.BuildUrl("", base, params)
+}
+
+// assetUrl returns the (fingerprinted) URL of a file in AssetsWebRoot: {{asset "css/app.css"}}
+func (r *TemplateRender) assetUrl(name string) string {
+	if r.Assets != nil {
+		name = r.Assets.HashedName(name)
+	}
+	return strings.TrimSuffix(r.AssetsUrlPrefix, "/") + "/" + strings.TrimPrefix(name, "/")
+}
+
+// tmplFuncFormatDate formats a time.Time, *time.Time or unix timestamp: {{formatDate .CreatedAt "2006-01-02 15:04"}}
+func tmplFuncFormatDate(v any, layouts ...string) string {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		t = *v
+	default:
+		unix := fmutil.AsInt64(v)
+		if unix == 0 {
+			return ""
+		}
+		t = time.Unix(unix, 0)
+	}
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(fmutil.Def(layouts, tmplDefaultDateLayout))
+}
+
+// tmplFuncJson encodes the value as a JS value: <script>const data = {{json .Data}};</script>.
+// json.Marshal escapes "<", ">" and "&", so it is safe inside the script elements.
+func tmplFuncJson(v any) (template.JS, error) {
+	buf, err := json.Marshal(v)
+	return template.JS(buf), err
+}
@@ -0,0 +1,137 @@
+package fmhttp
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"reflect"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+)
+
+// templateNames returns all template files in TemplateFS
+func (r *TemplateRender) templateNames() (names []string, err error) {
+	err = fs.WalkDir(r.TemplateFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".tmpl") {
+			names = append(names, path)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// errPrecompileStop stops the execution of Precompile at the first output, the templates are already escaped then
+var errPrecompileStop = errors.New("precompile stop")
+
+type precompileWriter struct{}
+
+func (precompileWriter) Write([]byte) (int, error) {
+	return 0, errPrecompileStop
+}
+
+// precompileStubFuncs returns the functions of the same signatures which return zero values,
+// so the functions of the users are not called at startup
+func (r *TemplateRender) precompileStubFuncs() template.FuncMap {
+	stubs := template.FuncMap{}
+	for name, fn := range r.funcMap {
+		fnType := reflect.TypeOf(fn)
+		stubs[name] = reflect.MakeFunc(fnType, func([]reflect.Value) []reflect.Value {
+			results := make([]reflect.Value, fnType.NumOut())
+			for i := range results {
+				results[i] = reflect.Zero(fnType.Out(i))
+			}
+			return results
+		}).Interface()
+	}
+	return stubs
+}
+
+// Precompile parses all templates with their dependencies and caches them, so the broken templates are found at startup.
+// The errors of all templates are reported, they contain the file names and lines.
+// The templates are also escaped (html/template escapes them before the execution) by executing a copy with stub functions,
+// the execution stops at the first output and the execution errors caused by the empty data are ignored.
+func (r *TemplateRender) Precompile() error {
+	names, err := r.templateNames()
+	if err != nil {
+		return err
+	}
+
+	stubs := r.precompileStubFuncs()
+	var errs []error
+	reported := map[string]bool{}
+	for _, name := range names {
+		t, err := r.loadTemplate(name)
+		if err == nil {
+			if t, err = t.Clone(); err == nil {
+				err = t.Funcs(stubs).Execute(precompileWriter{}, map[string]any{})
+				var execErr texttemplate.ExecError
+				if errors.Is(err, errPrecompileStop) || errors.As(err, &execErr) {
+					err = nil
+				}
+			}
+		}
+		// a broken partial is reported once, not for every template which uses it
+		if err != nil && !reported[err.Error()] {
+			reported[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ExecuteAll executes every entry template (which is not used by others as a partial or layout) with its sample data,
+// samples[""] is used for the templates without sample data. The missing map keys are reported as errors,
+// so it is useful in tests to catch the mismatches between the templates and the handlers.
+func (r *TemplateRender) ExecuteAll(samples map[string]map[string]any) error {
+	names, err := r.templateNames()
+	if err != nil {
+		return err
+	}
+
+	parsedMap := map[string]*template.Template{}
+	var errs []error
+	for _, name := range names {
+		if _, ok := parsedMap[name]; !ok {
+			if err = r.parseTemplate(parsedMap, name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	var deps []string
+	for _, parsed := range parsedMap {
+		deps = append(deps, templateDependencies(parsed)...)
+	}
+
+	for _, name := range names {
+		if slices.Contains(deps, name) {
+			continue
+		}
+		data, ok := samples[name]
+		if !ok {
+			data = samples[""]
+		}
+		if err = r.executeStrict(name, data); err != nil {
+			errs = append(errs, fmt.Errorf("execute %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// executeStrict parses the template again because the cached ones can't change options after executed
+func (r *TemplateRender) executeStrict(name string, data map[string]any) error {
+	parsedMap := map[string]*template.Template{}
+	if err := r.parseTemplate(parsedMap, name); err != nil {
+		return err
+	}
+	t, err := r.assembleTemplate(parsedMap, name)
+	if err != nil {
+		return err
+	}
+	return t.Option("missingkey=error").Execute(io.Discard, data)
+}
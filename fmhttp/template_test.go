@@ -0,0 +1,260 @@
+package fmhttp
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testTmplFS(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return fsys
+}
+
+func TestTemplateRenderLayout(t *testing.T) {
+	fsys := testTmplFS(map[string]string{
+		"layout/base.tmpl":    `<title>{{block "title" .}}Default{{end}}</title>{{block "content" .}}{{end}}{{template "partial/footer.tmpl" .}}`,
+		"layout/user.tmpl":    `{{layout "layout/base.tmpl"}}{{define "content"}}<nav>user</nav>{{block "main" .}}{{end}}{{end}}`,
+		"home.tmpl":           `{{layout "layout/base.tmpl"}}{{define "title"}}Home{{end}}{{define "content"}}{{range .Items}}{{if .}}{{template "partial/item.tmpl" .}}{{end}}{{end}}{{end}}`,
+		"profile.tmpl":        `{{layout "layout/user.tmpl"}}{{define "main"}}<p>{{.Name}}</p>{{end}}`,
+		"cycle.tmpl":          `{{layout "cycle.tmpl"}}`,
+		"partial/item.tmpl":   `<i>{{.}}</i>`,
+		"partial/footer.tmpl": `<footer></footer>`,
+	})
+	r := NewTemplateRender(fsys)
+
+	render := func(name string, data map[string]any) (string, error) {
+		sb := &strings.Builder{}
+		err := r.Render(sb, name, data)
+		return sb.String(), err
+	}
+
+	out, err := render("home.tmpl", map[string]any{"Items": []string{"a", "", "b"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, `<title>Home</title><i>a</i><i>b</i><footer></footer>`, out)
+
+	out, err = render("profile.tmpl", map[string]any{"Name": "<u>"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, `<title>Default</title><nav>user</nav><p>&lt;u&gt;</p><footer></footer>`, out)
+
+	_, err = render("cycle.tmpl", nil)
+	assert.ErrorContains(t, err, "layout cycle")
+}
+
+func TestTemplateRenderFuncs(t *testing.T) {
+	fsys := testTmplFS(map[string]string{
+		"funcs.tmpl": `{{url "/search" "q" "a b"}}|{{asset "css/app.css"}}|{{formatDate .Time}}|{{formatDate .Time "15:04"}}|{{json .Map}}|{{safeHTML "<b>"}}|{{hello}}`,
+	})
+	r := NewTemplateRender(fsys)
+	r.AssetsUrlPrefix = "/assets"
+	r.Funcs(template.FuncMap{"hello": func() string { return "hi" }})
+
+	sb := &strings.Builder{}
+	err := r.Render(sb, "funcs.tmpl", map[string]any{
+		"Time": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"Map":  map[string]any{"k": 1},
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, `/search?q=a&#43;b|/assets/css/app.css|2024-01-02|03:04|{&#34;k&#34;:1}|<b>|hi`, sb.String())
+}
+
+func TestTemplateRenderJsonAndPartialOrder(t *testing.T) {
+	fsys := testTmplFS(map[string]string{
+		"script.tmpl":    `<script>const data = {{json .Map}};</script>`,
+		"page.tmpl":      `{{template "partial/a.tmpl" .}}{{template "partial/c.tmpl" .}}{{template "item" .}}`,
+		"partial/a.tmpl": `{{define "item"}}a{{end}}`,
+		"partial/b.tmpl": `{{define "item"}}b{{end}}`,
+		"partial/c.tmpl": `{{template "partial/b.tmpl"}}`,
+	})
+	r := NewTemplateRender(fsys)
+	sb := &strings.Builder{}
+	assert.NoError(t, r.Render(sb, "script.tmpl", map[string]any{"Map": map[string]any{"k": "</script>"}}))
+	assert.EqualValues(t, `<script>const data = {"k":"\u003c/script\u003e"};</script>`, sb.String())
+
+	// the same block defined by the partials is taken from the last one in the name order
+	for i := 0; i < 5; i++ {
+		sb.Reset()
+		r = NewTemplateRender(fsys)
+		assert.NoError(t, r.Render(sb, "page.tmpl", nil))
+		assert.EqualValues(t, "b", sb.String())
+	}
+}
+
+func TestTemplateRenderPrecompile(t *testing.T) {
+	fsys := testTmplFS(map[string]string{
+		"ok.tmpl":            `{{template "partial/ok.tmpl" .}}`,
+		"partial/ok.tmpl":    `<p>{{.Name}}</p>`,
+		"broken.tmpl":        "line1\n{{if .X}}",
+		"missing.tmpl":       `{{template "partial/missing.tmpl" .}}`,
+		"bad-escape.tmpl":    `<a href="{{if .X}}/a"{{end}}>`,
+		"uses-broken.tmpl":   `{{template "broken.tmpl" .}}`,
+		"uses-missing.tmpl":  `{{template "missing.tmpl" .}}`,
+		"layout/base.tmpl":   `{{block "content" .}}{{end}}`,
+		"with-layout.tmpl":   `{{layout "layout/base.tmpl"}}{{define "content"}}{{.Name}}{{end}}`,
+		"partial/other.tmpl": `{{.Other}}`,
+	})
+	r := NewTemplateRender(fsys)
+	err := r.Precompile()
+	assert.Error(t, err)
+	msg := err.Error()
+	assert.Contains(t, msg, "broken.tmpl:2:")
+	assert.Contains(t, msg, "partial/missing.tmpl")
+	assert.Contains(t, msg, "bad-escape.tmpl:1:")
+	assert.EqualValues(t, 1, strings.Count(msg, "broken.tmpl:2:"))
+	assert.NotContains(t, msg, "ok.tmpl")
+
+	// the functions of the users are not called by Precompile
+	called := false
+	fsys = testTmplFS(map[string]string{
+		"funcs.tmpl":      `{{range boom}}{{.}}{{end}}{{boom | len}}`,
+		"bad-escape.tmpl": `{{boom}}<a href="{{if .X}}/a"{{end}}>`,
+	})
+	r = NewTemplateRender(fsys)
+	r.Funcs(template.FuncMap{"boom": func() ([]string, error) {
+		called = true
+		return nil, errors.New("boom")
+	}})
+	err = r.Precompile()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad-escape.tmpl:1:")
+		assert.NotContains(t, err.Error(), "funcs.tmpl")
+	}
+	assert.False(t, called)
+
+	fsys = testTmplFS(map[string]string{
+		"page.tmpl":          `{{template "partial/name.tmpl" .}}`,
+		"partial/name.tmpl":  `{{.Name}}`,
+		"other.tmpl":         `{{.Title}}`,
+		"layout/base.tmpl":   `{{block "content" .}}{{end}}`,
+		"with-layout.tmpl":   `{{layout "layout/base.tmpl"}}{{define "content"}}{{.Name}}{{end}}`,
+		"partial/title.tmpl": `{{.Title}}`,
+	})
+	r = NewTemplateRender(fsys)
+	err = r.ExecuteAll(map[string]map[string]any{
+		"":          {"Name": "n"},
+		"page.tmpl": {"Name": "n"},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "execute other.tmpl")
+		// an unused partial is executed as an entry, the used partials and layouts are only executed by the pages
+		assert.Contains(t, err.Error(), "execute partial/title.tmpl")
+		assert.NotContains(t, err.Error(), "partial/name.tmpl")
+		assert.NotContains(t, err.Error(), "page.tmpl")
+		assert.NotContains(t, err.Error(), "with-layout.tmpl")
+	}
+}
+
+func TestTemplateRenderWatch(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour)
+	fsys := fstest.MapFS{
+		"a.tmpl":       {Data: []byte(`a:{{template "partial.tmpl"}}`), ModTime: t0},
+		"b.tmpl":       {Data: []byte(`b`), ModTime: t0},
+		"partial.tmpl": {Data: []byte(`p1`), ModTime: t0},
+	}
+	r := NewTemplateRender(fsys)
+	r.DevMode = true
+	r.WatchInterval = time.Nanosecond
+
+	render := func(name string) string {
+		sb := &strings.Builder{}
+		assert.NoError(t, r.Render(sb, name, nil))
+		return sb.String()
+	}
+	assert.EqualValues(t, "a:p1", render("a.tmpl"))
+	assert.EqualValues(t, "b", render("b.tmpl"))
+	tmplB := r.cachedTemplates["b.tmpl"]
+
+	fsys["partial.tmpl"] = &fstest.MapFile{Data: []byte(`p2`), ModTime: t0.Add(time.Second)}
+	assert.EqualValues(t, "a:p2", render("a.tmpl"))
+	assert.EqualValues(t, "b", render("b.tmpl"))
+	assert.Same(t, tmplB, r.cachedTemplates["b.tmpl"])
+}
+
+// testHookFS calls onOpen after a file is opened, eg: to change the files while a template is being parsed
+type testHookFS struct {
+	fs.FS
+	onOpen func(name string)
+}
+
+func (f testHookFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	f.onOpen(name)
+	return file, err
+}
+
+func TestTemplateRenderWatchDuringParse(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour)
+	fsys := fstest.MapFS{"c.tmpl": {Data: []byte(`c1`), ModTime: t0}}
+	var r *TemplateRender
+	changing := true
+	r = NewTemplateRender(testHookFS{FS: fsys, onOpen: func(name string) {
+		if changing && name == "c.tmpl" {
+			// the change is detected by another render while the old content is being parsed
+			changing = false
+			fsys["c.tmpl"] = &fstest.MapFile{Data: []byte(`c2`), ModTime: t0.Add(time.Second)}
+			r.invalidateChangedTemplates()
+		}
+	}})
+	r.DevMode = true
+	r.WatchInterval = time.Nanosecond
+
+	render := func(name string) string {
+		sb := &strings.Builder{}
+		assert.NoError(t, r.Render(sb, name, nil))
+		return sb.String()
+	}
+	assert.EqualValues(t, "c1", render("c.tmpl"))
+	// the stale template is not cached
+	assert.EqualValues(t, "c2", render("c.tmpl"))
+}
+
+func TestRespondTmplError(t *testing.T) {
+	assetsFS := fstest.MapFS{
+		"assets/template/ok.tmpl":     {Data: []byte(`<p>{{.Name}}</p>`)},
+		"assets/template/broken.tmpl": {Data: []byte("<p>\n{{.Name.Missing}}</p>")},
+		"assets/template/error.tmpl":  {Data: []byte(`error {{.StatusCode}}`)},
+	}
+	serve := func(hs *HttpServer, name string, status int) *httptest.ResponseRecorder {
+		handler := hs.wrapHandlers(func(c *Context) Response {
+			return c.RespondTmpl(name, map[string]any{"Name": "n"}).SetStatusCode(status)
+		})
+		return testServe(handler, "GET", "/")
+	}
+
+	hs := testHttpServer(&Options{AssetsFS: assetsFS, ErrorTemplate: "error.tmpl"})
+	w := serve(hs, "ok.tmpl", http.StatusCreated)
+	assert.EqualValues(t, http.StatusCreated, w.Code)
+	assert.EqualValues(t, "<p>n</p>", w.Body.String())
+	assert.EqualValues(t, "8", w.Header().Get("Content-Length"))
+	assert.EqualValues(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// nothing of the failed template is written, the status code of the handler is not used
+	w = serve(hs, "broken.tmpl", http.StatusCreated)
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.EqualValues(t, "error 500", w.Body.String())
+
+	assert.EqualValues(t, http.StatusNotFound, serve(hs, "no-such.tmpl", 0).Code)
+
+	hs = testHttpServer(&Options{AssetsFS: assetsFS})
+	w = serve(hs, "broken.tmpl", 0)
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.EqualValues(t, "internal error (render template error)", w.Body.String())
+
+	hs.tmplRender.DevMode = true
+	hs.devMode = true
+	w = serve(hs, "broken.tmpl", 0)
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "Failed to render template broken.tmpl")
+	assert.Contains(t, w.Body.String(), `<span class="error-line">   2  {{.Name.Missing}}&lt;/p&gt;</span>`)
+	assert.Contains(t, w.Body.String(), "<li>broken.tmpl</li>")
+}
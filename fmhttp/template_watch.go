@@ -0,0 +1,93 @@
+package fmhttp
+
+import (
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTemplateWatchInterval = time.Second
+
+type templateFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// templateWatcher detects the changed template files by polling their stats, it works with any fs.FS.
+// The check is done by one render at most once per interval, other renders don't wait for it.
+type templateWatcher struct {
+	mu        sync.Mutex
+	lastCheck time.Time
+	stats     map[string]templateFileStat
+}
+
+func (r *TemplateRender) templateFileStats() (map[string]templateFileStat, error) {
+	stats := map[string]templateFileStat{}
+	err := fs.WalkDir(r.TemplateFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".tmpl") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats[path] = templateFileStat{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return stats, err
+}
+
+// invalidateChangedTemplates removes the cached templates which use the changed (or removed) files
+func (r *TemplateRender) invalidateChangedTemplates() {
+	w := &r.watcher
+	if !w.mu.TryLock() {
+		return
+	}
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.lastCheck) < fmutil.IfZero(r.WatchInterval, defaultTemplateWatchInterval) {
+		return
+	}
+	w.lastCheck = now
+
+	stats, err := r.templateFileStats()
+	if err != nil {
+		// the directory may be changed by an editor at the moment, check it next time
+		return
+	}
+	oldStats := w.stats
+	w.stats = stats
+	if oldStats == nil {
+		return
+	}
+
+	var changed []string
+	for name, stat := range oldStats {
+		if newStat, ok := stats[name]; !ok || newStat != stat {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	r.cachedTemplatesMu.Lock()
+	defer r.cachedTemplatesMu.Unlock()
+	r.cachedTemplatesGen++
+	for tmplName, files := range r.cachedTemplateFiles {
+		for _, file := range files {
+			if slices.Contains(changed, file) {
+				delete(r.cachedTemplates, tmplName)
+				delete(r.cachedTemplateFiles, tmplName)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package fmhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTlsReloadInterval = 10 * time.Second
+
+// certReloader loads the certificate key pair and reloads it when the files are changed,
+// the files are checked at most once per interval by one of the TLS handshakes, the others are not blocked.
+type certReloader struct {
+	fsys     fs.FS
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	cert      atomic.Pointer[tls.Certificate]
+	lastCheck atomic.Int64 // unix nanoseconds
+
+	// mu serializes the reloads
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func newCertReloader(fsys fs.FS, certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	cr := &certReloader{fsys: fsys, certFile: certFile, keyFile: keyFile, interval: interval}
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = cr.load(modTime); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) latestModTime() (t time.Time, err error) {
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		st, err := fs.Stat(cr.fsys, name)
+		if err != nil {
+			return t, err
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (cr *certReloader) load(modTime time.Time) error {
+	certPEM, err := fs.ReadFile(cr.fsys, cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := fs.ReadFile(cr.fsys, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	cr.cert.Store(&cert)
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now().UnixNano()
+	lastCheck := cr.lastCheck.Load()
+	if cr.interval > 0 && now-lastCheck >= int64(cr.interval) && cr.lastCheck.CompareAndSwap(lastCheck, now) {
+		cr.reload()
+	}
+	return cr.cert.Load(), nil
+}
+
+func (cr *certReloader) reload() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	modTime, err := cr.latestModTime()
+	if err == nil && !modTime.Equal(cr.modTime) {
+		// the cert and key files may be written one by one, keep the old certificate until both are valid
+		if err = cr.load(modTime); err == nil {
+			fmlog.Infof("fmhttp: reloaded TLS certificate %s", cr.certFile)
+		}
+	}
+	if err != nil {
+		fmlog.Warnf("fmhttp: failed to reload TLS certificate %s, err: %v", cr.certFile, err)
+	}
+}
+
+func (hs *HttpServer) initTls(opt *Options) {
+	if opt.TlsCertFile == "" && opt.TlsKeyFile == "" {
+		return
+	}
+	fmutil.MustTrue(opt.TlsCertFile != "" && opt.TlsKeyFile != "", "both TlsCertFile and TlsKeyFile are required for TLS")
+
+	tlsFS := opt.TlsFS
+	if tlsFS == nil {
+		tlsFS = osFS{}
+	}
+	reloader, err := newCertReloader(tlsFS, opt.TlsCertFile, opt.TlsKeyFile, fmutil.IfZero(opt.TlsReloadInterval, defaultTlsReloadInterval))
+	fmutil.MustNoError(err, "can not load TLS certificate")
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if opt.TlsClientCAFile != "" {
+		caPEM, err := fs.ReadFile(tlsFS, opt.TlsClientCAFile)
+		fmutil.MustNoError(err, "can not read TLS client CA file")
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		fmutil.MustTrue(tlsConfig.ClientCAs.AppendCertsFromPEM(caPEM), "no valid certificate in TLS client CA file %s", opt.TlsClientCAFile)
+		tlsConfig.ClientAuth = fmutil.IfZero(opt.TlsClientAuth, tls.RequireAndVerifyClientCert)
+	}
+
+	hs.tlsEnabled = true
+	hs.server.TLSConfig = tlsConfig
+	if !opt.EnableHttp2 {
+		// a non-nil empty map disables the automatic HTTP/2 support of net/http
+		hs.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
+
+func (hs *HttpServer) isTls() bool {
+	// not to check server.TLSConfig, because net/http sets it when serving
+	return hs.tlsEnabled
+}
+
+// osFS opens the names as OS file paths (relative or absolute), which is not allowed by os.DirFS
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// TlsPeerCertificate returns the verified client certificate of a mTLS connection, or nil if there is none
+func (c *Context) TlsPeerCertificate() *x509.Certificate {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return c.Request.TLS.VerifiedChains[0][0]
+}
+
+// TlsPeerIdentity returns the subject common name of the verified client certificate, or empty if there is none
+func (c *Context) TlsPeerIdentity() string {
+	if cert := c.TlsPeerCertificate(); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package fmhttp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed one if the parent is nil
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func testCertKeyPEM(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	c := newTestCert(t, cn, false, nil)
+	return c.certPEM, c.keyPEM
+}
+
+func TestCertReloader(t *testing.T) {
+	fsys := fstest.MapFS{}
+	setCert := func(cn string, modTime time.Time) {
+		certPEM, keyPEM := testCertKeyPEM(t, cn)
+		fsys["cert.pem"] = &fstest.MapFile{Data: certPEM, ModTime: modTime}
+		fsys["key.pem"] = &fstest.MapFile{Data: keyPEM, ModTime: modTime}
+	}
+	commonName := func(cr *certReloader) string {
+		cert, err := cr.GetCertificate(nil)
+		assert.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+
+	t0 := time.Now().Add(-time.Minute)
+	setCert("first", t0)
+	cr, err := newCertReloader(fsys, "cert.pem", "key.pem", time.Nanosecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "first", commonName(cr))
+
+	setCert("second", t0.Add(time.Second))
+	assert.EqualValues(t, "second", commonName(cr))
+
+	// a broken key pair doesn't replace the working certificate
+	fsys["key.pem"] = &fstest.MapFile{Data: []byte("broken"), ModTime: t0.Add(2 * time.Second)}
+	assert.EqualValues(t, "second", commonName(cr))
+}
+
+func TestTlsClientCert(t *testing.T) {
+	ca := newTestCert(t, "test-ca", true, nil)
+	serverCert := newTestCert(t, "server", false, nil)
+	clientCert := newTestCert(t, "client-1", false, ca)
+	otherCert := newTestCert(t, "client-2", false, nil)
+
+	hs := testHttpServer(&Options{
+		Listen:          "127.0.0.1:0",
+		TlsCertFile:     "cert.pem",
+		TlsKeyFile:      "key.pem",
+		TlsClientCAFile: "ca.pem",
+		TlsFS: fstest.MapFS{
+			"cert.pem": {Data: serverCert.certPEM},
+			"key.pem":  {Data: serverCert.keyPEM},
+			"ca.pem":   {Data: ca.certPEM},
+		},
+	})
+	hs.HandleRequest("/whoami", func(c *Context) Response {
+		return c.Respond(200, c.TlsPeerIdentity())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- hs.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-runErr)
+	}()
+	assert.Eventually(t, func() bool { return len(hs.ListenAddrs()) == 1 }, time.Second, 10*time.Millisecond)
+	url := "https://" + hs.ListenAddrs()[0].String() + "/whoami"
+
+	get := func(clientCert *testCert) (string, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if clientCert != nil {
+			pair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+			assert.NoError(t, err)
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	identity, err := get(clientCert)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "client-1", identity)
+
+	// the clients without a certificate or with an unknown one are rejected by the handshake
+	_, err = get(nil)
+	assert.Error(t, err)
+	_, err = get(otherCert)
+	assert.Error(t, err)
+}
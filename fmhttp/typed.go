@@ -0,0 +1,86 @@
+package fmhttp
+
+import (
+	"github.com/go-farmyard/farmyard/fmutil"
+	"net/http"
+	"reflect"
+)
+
+// TypedHandler is an endpoint built by Typed, the input and output types are kept for the API documents
+type TypedHandler struct {
+	InType  reflect.Type
+	OutType reflect.Type
+	Doc     ApiDoc
+	opt     NegotiateOptions
+	handle  func(c *Context) Response
+}
+
+// ApiDoc describes the operation of a TypedHandler in the OpenAPI document
+type ApiDoc struct {
+	// OperationID names the route, eg: "getUser"
+	OperationID string
+	Summary     string
+	Description string
+	Tags        []string
+	Deprecated  bool
+}
+
+func (h *TypedHandler) Handle(c *Context) Response {
+	return h.handle(c)
+}
+
+// WithDoc sets the document of the operation, eg: Typed(getUser).WithDoc(ApiDoc{OperationID: "getUser", Tags: []string{"users"}})
+func (h *TypedHandler) WithDoc(doc ApiDoc) *TypedHandler {
+	h.Doc = doc
+	return h
+}
+
+// Typed builds an endpoint from a typed function: the input (a struct or a pointer to struct) is bound by c.Bind
+// and checked by Validate, the output is responded by RespondNegotiated with the options, eg:
+//
+//	r.Get("/users/{id}", fmhttp.Typed(func(c *fmhttp.Context, in GetUserReq) (*User, error) { ... }))
+//
+// The errors are responded by the ErrorHandler, eg: 400 for the invalid parameters and 422 for the validation errors.
+// If the output is a Response, it is responded as it is. A nil output without error responds 204.
+func Typed[In, Out any](fn func(c *Context, in In) (Out, error), opts ...NegotiateOptions) *TypedHandler {
+	inType := reflect.TypeFor[In]()
+	structType := inType
+	if structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	fmutil.MustTrue(structType.Kind() == reflect.Struct, "typed handler input must be a struct or a pointer to struct, but: %s", inType)
+
+	return &TypedHandler{
+		InType:  inType,
+		OutType: reflect.TypeFor[Out](),
+		opt:     fmutil.DefZero(opts),
+		handle: func(c *Context) Response {
+			inPtr := reflect.New(structType)
+			if err := c.Bind(inPtr.Interface()); err != nil {
+				return c.Respond(err)
+			}
+			if err := Validate(inPtr.Interface()); err != nil {
+				return c.Respond(err)
+			}
+			var in In
+			if inType.Kind() == reflect.Pointer {
+				in = inPtr.Interface().(In)
+			} else {
+				in = inPtr.Elem().Interface().(In)
+			}
+
+			out, err := fn(c, in)
+			if err != nil {
+				return c.Respond(err)
+			}
+			if resp, ok := any(out).(Response); ok {
+				return resp
+			}
+			outValue := reflect.ValueOf(out)
+			if !outValue.IsValid() || outValue.Kind() == reflect.Pointer && outValue.IsNil() {
+				return c.Respond(http.StatusNoContent)
+			}
+			return c.RespondNegotiated(out, opts...)
+		},
+	}
+}
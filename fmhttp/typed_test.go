@@ -0,0 +1,71 @@
+package fmhttp
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testGetItemReq struct {
+	ID int64 `path:"id" validate:"min=1"`
+}
+
+type testItem struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type testCreateItemReq struct {
+	Name string `json:"name" validate:"required"`
+}
+
+func TestTyped(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Get("/items/{id}", Typed(func(c *Context, in testGetItemReq) (*testItem, error) {
+		if in.ID == 404 {
+			return nil, sql.ErrNoRows
+		} else if in.ID == 204 {
+			return nil, nil
+		}
+		return &testItem{ID: in.ID, Name: "item"}, nil
+	}, NegotiateOptions{Formats: []string{FormatJson, FormatXml}}))
+	r.Post("/items", Typed(func(c *Context, in *testCreateItemReq) (*testItem, error) {
+		return &testItem{ID: 1, Name: in.Name}, nil
+	}, NegotiateOptions{StatusCode: http.StatusCreated}))
+	r.Delete("/items/{id}", Typed(func(c *Context, in testGetItemReq) (Response, error) {
+		return c.Respond(http.StatusAccepted), nil
+	}))
+	handler := hs.wrapHandlers(r)
+	serve := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return testServeRequest(handler, req)
+	}
+
+	w := serve("GET", "/items/3", "")
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":3,"name":"item"}`, w.Body.String())
+	w = serve("GET", "/items/3", "", "Accept", "application/xml")
+	assert.Contains(t, w.Body.String(), "<Name>item</Name>")
+
+	w = serve("GET", "/items/0", "")
+	assert.EqualValues(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"errors":{"id":"must be at least 1"}`)
+	assert.EqualValues(t, http.StatusBadRequest, serve("GET", "/items/abc", "").Code)
+	assert.EqualValues(t, http.StatusNotFound, serve("GET", "/items/404", "").Code)
+	assert.EqualValues(t, http.StatusNoContent, serve("GET", "/items/204", "").Code)
+
+	w = serve("POST", "/items", `{"name":"new"}`)
+	assert.EqualValues(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"id":1,"name":"new"}`, w.Body.String())
+	assert.EqualValues(t, http.StatusUnprocessableEntity, serve("POST", "/items", `{}`).Code)
+
+	assert.EqualValues(t, http.StatusAccepted, serve("DELETE", "/items/1", "").Code)
+}
@@ -0,0 +1,380 @@
+package fmhttp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultUploadMaxMemory      = 32 << 20
+	defaultUploadMaxRequestSize = 100 << 20
+)
+
+// UploadOptions are the limits of an upload endpoint, the zero fields use the server's options
+type UploadOptions struct {
+	// MaxMemory is the memory for the parsed multipart form, the larger files are stored in temporary files
+	MaxMemory int64
+	// MaxFileSize is the maximum size of each file, zero means only limited by MaxRequestSize
+	MaxFileSize int64
+	// MaxRequestSize is the maximum size of the request body
+	MaxRequestSize int64
+	// AllowedExtensions are the allowed file extensions (case-insensitive), eg: ".png", ".jpg". Empty allows all.
+	AllowedExtensions []string
+	// AllowedTypes are the allowed MIME types sniffed from the content (not sent by the client), eg: "image/png", "image/*". Empty allows all.
+	AllowedTypes []string
+}
+
+func (c *Context) uploadOptions(opts []UploadOptions) UploadOptions {
+	hs := c.HttpServer
+	opt := fmutil.DefZero(opts)
+	opt.MaxMemory = fmutil.IfZero(opt.MaxMemory, hs.uploadMaxMemory)
+	opt.MaxFileSize = fmutil.IfZero(opt.MaxFileSize, hs.uploadMaxFileSize)
+	opt.MaxRequestSize = fmutil.IfZero(opt.MaxRequestSize, hs.uploadMaxRequestSize)
+	return opt
+}
+
+// UploadStorage stores the uploaded files, eg: LocalUploadStorage, or a wrapper of an object storage
+type UploadStorage interface {
+	// Create creates a new file, the name is generated by the server and is safe to be used as a path
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+// LocalUploadStorage stores the files in a local directory, the directory is created if it doesn't exist
+type LocalUploadStorage struct {
+	Dir string
+}
+
+func (s LocalUploadStorage) Create(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(s.Dir, filepath.Base(name)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+func (s LocalUploadStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+// UploadedFile is a validated uploaded file
+type UploadedFile struct {
+	Field string
+	// Filename is the base name sent by the client, it should only be displayed, never be used as a path
+	Filename string
+	Size     int64
+	// ContentType is sniffed from the content
+	ContentType string
+	// StoredName is the name in the storage after it is saved
+	StoredName string
+
+	header *multipart.FileHeader
+}
+
+// Open opens the parsed file (from memory or the temporary file), it is only available for the files returned by FormFile(s)
+func (f *UploadedFile) Open() (multipart.File, error) {
+	if f.header == nil {
+		return nil, errors.New("the uploaded file is already saved")
+	}
+	return f.header.Open()
+}
+
+// Save copies the parsed file to the storage with a safe generated name
+func (f *UploadedFile) Save(storage UploadStorage) error {
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	name := safeUploadName(f.Filename)
+	if _, err = saveToStorage(storage, name, src); err != nil {
+		return err
+	}
+	f.StoredName = name
+	return nil
+}
+
+func saveToStorage(storage UploadStorage, name string, src io.Reader) (int64, error) {
+	dst, err := storage.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = storage.Remove(name)
+	}
+	return n, err
+}
+
+// safeUploadName generates a random name with the lowercase extension of the client's filename
+func safeUploadName(filename string) string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	ext := strings.ToLower(path.Ext(filename))
+	for _, r := range ext[min(1, len(ext)):] {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			ext = ""
+			break
+		}
+	}
+	return hex.EncodeToString(buf) + ext
+}
+
+// cleanUploadFilename keeps the base name of the client's filename, some browsers send the full path
+func cleanUploadFilename(filename string) string {
+	filename = filename[strings.LastIndexAny(filename, `/\`)+1:]
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename))
+}
+
+// ErrFormAlreadyParsed is wrapped by the 400 error of SaveFormFiles if the body has been read before it
+var ErrFormAlreadyParsed = errors.New("the form is already parsed")
+
+func errUploadTooLarge(detail string) *HttpError {
+	return NewHttpError(http.StatusRequestEntityTooLarge, detail).WithCode("upload_too_large")
+}
+
+func (opt *UploadOptions) checkExtension(filename string) error {
+	if len(opt.AllowedExtensions) == 0 {
+		return nil
+	}
+	ext := path.Ext(filename)
+	for _, allowed := range opt.AllowedExtensions {
+		if strings.EqualFold(ext, allowed) {
+			return nil
+		}
+	}
+	return NewHttpError(http.StatusUnsupportedMediaType, "file extension not allowed: "+filename).WithCode("upload_type_not_allowed")
+}
+
+func (opt *UploadOptions) checkContentType(contentType, filename string) error {
+	if len(opt.AllowedTypes) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, allowed := range opt.AllowedTypes {
+		if allowed == mediaType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return nil
+		}
+	}
+	return NewHttpError(http.StatusUnsupportedMediaType, "file type not allowed: "+filename).WithCode("upload_type_not_allowed")
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(headerContentType))
+	return mediaType == "multipart/form-data"
+}
+
+// parseMultipartForm parses the multipart body once, the temporary files are removed after the request
+func (c *Context) parseMultipartForm(opt *UploadOptions) error {
+	r := c.Request
+	if r.MultipartForm != nil {
+		return nil
+	}
+	r.Body = http.MaxBytesReader(c.ResponseWriter, r.Body, opt.MaxRequestSize)
+	err := r.ParseMultipartForm(opt.MaxMemory)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errUploadTooLarge("request body too large").Wrap(err)
+	} else if err != nil {
+		return NewHttpError(http.StatusBadRequest, "invalid multipart form").Wrap(err)
+	}
+	return nil
+}
+
+// parseForm parses the form body once, the errors are *HttpError, eg: 400 for a malformed body, 413 for a too large one
+func (c *Context) parseForm() error {
+	if c.Request.PostForm != nil {
+		return nil
+	}
+	if isMultipartRequest(c.Request) {
+		return c.parseMultipartForm(fmutil.Ptr(c.uploadOptions(nil)))
+	}
+	err := c.Request.ParseForm()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return NewHttpError(http.StatusRequestEntityTooLarge, "request body too large").WithCode("body_too_large").Wrap(err)
+	} else if err != nil {
+		return NewHttpError(http.StatusBadRequest, "invalid form body").WithCode("invalid_body").Wrap(err)
+	}
+	return nil
+}
+
+func (opt *UploadOptions) validateFileHeader(field string, fh *multipart.FileHeader) (*UploadedFile, error) {
+	f := &UploadedFile{Field: field, Filename: cleanUploadFilename(fh.Filename), Size: fh.Size, header: fh}
+	if opt.MaxFileSize > 0 && fh.Size > opt.MaxFileSize {
+		return nil, errUploadTooLarge("file too large: " + f.Filename)
+	}
+	if err := opt.checkExtension(f.Filename); err != nil {
+		return nil, err
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	f.ContentType = http.DetectContentType(head[:n])
+	return f, opt.checkContentType(f.ContentType, f.Filename)
+}
+
+// FormFiles returns the validated files of a multipart form field, the form is parsed with the limits of the options,
+// and the temporary files are removed after the request. The errors are *HttpError (eg: 413, 415) which could be responded directly.
+func (c *Context) FormFiles(name string, opts ...UploadOptions) ([]*UploadedFile, error) {
+	opt := c.uploadOptions(opts)
+	if err := c.parseMultipartForm(&opt); err != nil {
+		return nil, err
+	}
+	var files []*UploadedFile
+	for _, fh := range c.Request.MultipartForm.File[name] {
+		f, err := opt.validateFileHeader(name, fh)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// FormFile returns the first validated file of a multipart form field, see FormFiles
+func (c *Context) FormFile(name string, opts ...UploadOptions) (*UploadedFile, error) {
+	files, err := c.FormFiles(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "missing file: "+name).WithCode("upload_missing").Wrap(http.ErrMissingFile)
+	}
+	return files[0], nil
+}
+
+// SaveFormFiles streams all files of a multipart request straight to the storage without buffering them,
+// the other fields are available by PostParam or FormParam after it. If any file is invalid, the saved files are removed.
+// If the multipart form has been parsed (eg: by PostParam or the Csrf middleware), the parsed files are saved instead.
+// It returns ErrFormAlreadyParsed if the body has been read in another way, eg: by a former SaveFormFiles.
+func (c *Context) SaveFormFiles(storage UploadStorage, opts ...UploadOptions) (files []*UploadedFile, err error) {
+	opt := c.uploadOptions(opts)
+	r := c.Request
+	if r.MultipartForm != nil && r.MultipartForm.File != nil {
+		return c.saveParsedFormFiles(storage, &opt)
+	} else if r.PostForm != nil || r.MultipartForm != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "the multipart form is already parsed").WithCode("form_already_parsed").Wrap(ErrFormAlreadyParsed)
+	}
+	r.Body = http.MaxBytesReader(c.ResponseWriter, r.Body, opt.MaxRequestSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "invalid multipart form").Wrap(err)
+	}
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = storage.Remove(f.StoredName)
+			}
+			files = nil
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			err = errUploadTooLarge("request body too large").Wrap(err)
+		}
+	}()
+
+	r.PostForm = url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			// fill the form like ParseMultipartForm, the later FormValue or FormParam don't parse the consumed body again
+			r.MultipartForm = &multipart.Form{Value: r.PostForm}
+			_ = r.ParseForm()
+			return files, nil
+		} else if err != nil {
+			return files, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, opt.MaxMemory+1))
+			if err != nil {
+				return files, err
+			} else if int64(len(value)) > opt.MaxMemory {
+				return files, errUploadTooLarge("form field too large: " + part.FormName())
+			}
+			r.PostForm.Add(part.FormName(), string(value))
+			continue
+		}
+
+		f := &UploadedFile{Field: part.FormName(), Filename: cleanUploadFilename(part.FileName())}
+		if err = opt.checkExtension(f.Filename); err != nil {
+			return files, err
+		}
+		br := bufio.NewReaderSize(part, 512)
+		head, _ := br.Peek(512)
+		f.ContentType = http.DetectContentType(head)
+		if err = opt.checkContentType(f.ContentType, f.Filename); err != nil {
+			return files, err
+		}
+
+		var src io.Reader = br
+		if opt.MaxFileSize > 0 {
+			src = io.LimitReader(br, opt.MaxFileSize+1)
+		}
+		name := safeUploadName(f.Filename)
+		if f.Size, err = saveToStorage(storage, name, src); err != nil {
+			return files, err
+		}
+		f.StoredName = name
+		files = append(files, f)
+		if opt.MaxFileSize > 0 && f.Size > opt.MaxFileSize {
+			return files, errUploadTooLarge("file too large: " + f.Filename)
+		}
+	}
+}
+
+// saveParsedFormFiles saves the files of the parsed multipart form with the limits of the options,
+// the files are saved in the order of the field names. If any file is invalid, the saved files are removed.
+func (c *Context) saveParsedFormFiles(storage UploadStorage, opt *UploadOptions) (files []*UploadedFile, err error) {
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = storage.Remove(f.StoredName)
+			}
+			files = nil
+		}
+	}()
+	form := c.Request.MultipartForm
+	var totalSize int64
+	for _, field := range slices.Sorted(maps.Keys(form.File)) {
+		for _, fh := range form.File[field] {
+			if totalSize += fh.Size; totalSize > opt.MaxRequestSize {
+				return files, errUploadTooLarge("request body too large")
+			}
+			f, err := opt.validateFileHeader(field, fh)
+			if err != nil {
+				return files, err
+			}
+			if err = f.Save(storage); err != nil {
+				return files, err
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,191 @@
+package fmhttp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPngData = append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+
+func newUploadRequest(fields map[string]string, files ...[2]string) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	for _, file := range files {
+		fw, _ := mw.CreateFormFile("file", file[0])
+		_, _ = fw.Write([]byte(file[1]))
+	}
+	_ = mw.Close()
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestFormFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	storage := LocalUploadStorage{Dir: filepath.Join(t.TempDir(), "uploads")}
+	hs := testHttpServer(&Options{UploadMaxMemory: 10, UploadMaxFileSize: 1000})
+	r := NewRouter()
+	r.Post("/upload", func(c *Context) Response {
+		f, err := c.FormFile("file", UploadOptions{AllowedExtensions: []string{".png"}, AllowedTypes: []string{"image/*"}})
+		if err != nil {
+			return c.Respond(err)
+		}
+		if err = f.Save(storage); err != nil {
+			return c.Respond(err)
+		}
+		return c.RespondJson(map[string]any{"title": c.PostParam("title"), "name": f.Filename, "type": f.ContentType, "size": f.Size, "stored": f.StoredName})
+	})
+	handler := hs.wrapHandlers(r)
+	w := testServeRequest(handler, newUploadRequest(map[string]string{"title": "logo"}, [2]string{`..\..\dir/Logo.PNG`, string(testPngData)}))
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"title":"logo","type":"image/png"`)
+	assert.Contains(t, w.Body.String(), `"name":"Logo.PNG","size":108`)
+	entries, _ := os.ReadDir(storage.Dir)
+	if assert.Len(t, entries, 1) {
+		assert.Regexp(t, `^[0-9a-f]{32}\.png$`, entries[0].Name())
+		content, _ := os.ReadFile(filepath.Join(storage.Dir, entries[0].Name()))
+		assert.EqualValues(t, testPngData, content)
+	}
+	// the temporary files of the parsed form are removed after the request
+	entries, _ = os.ReadDir(tmpDir)
+	assert.Empty(t, entries)
+
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"fake.png", "plain text"}))
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, w.Code)
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"image.gif", string(testPngData)}))
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, w.Code)
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"large.png", string(testPngData) + strings.Repeat("a", 1000)}))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "upload_too_large")
+	w = testServeRequest(handler, newUploadRequest(map[string]string{"title": "logo"}))
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "upload_missing")
+}
+
+func TestSaveFormFiles(t *testing.T) {
+	storage := LocalUploadStorage{Dir: t.TempDir()}
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Post("/upload", func(c *Context) Response {
+		files, err := c.SaveFormFiles(storage, UploadOptions{MaxFileSize: 200, MaxRequestSize: 1000})
+		if err != nil {
+			return c.Respond(err)
+		}
+		// the streamed body can't be read again
+		_, err = c.SaveFormFiles(storage)
+		assert.ErrorIs(t, err, ErrFormAlreadyParsed)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Filename+":"+f.ContentType)
+		}
+		return c.RespondJson(map[string]any{"title": c.PostParam("title"), "files": names, "form": c.Request.FormValue("title") + "," + c.FormParam("page")})
+	})
+	handler := hs.wrapHandlers(r)
+	req := newUploadRequest(map[string]string{"title": "docs"}, [2]string{"a.png", string(testPngData)}, [2]string{"b.txt", "hello"})
+	req.URL.RawQuery = "page=2"
+	w := testServeRequest(handler, req)
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"title":"docs","files":["a.png:image/png","b.txt:text/plain; charset=utf-8"],"form":"docs,2"}`, w.Body.String())
+	entries, _ := os.ReadDir(storage.Dir)
+	assert.Len(t, entries, 2)
+
+	// the saved files are removed if a later one is invalid
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"c.png", string(testPngData)}, [2]string{"d.txt", strings.Repeat("a", 201)}))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"e.png", string(testPngData)}, [2]string{"f.txt", strings.Repeat("a", 190)}, [2]string{"g.txt", strings.Repeat("a", 190)}, [2]string{"h.txt", strings.Repeat("a", 190)}, [2]string{"i.txt", strings.Repeat("a", 190)}))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.Code)
+	entries, _ = os.ReadDir(storage.Dir)
+	assert.Len(t, entries, 2)
+}
+
+func TestSaveFormFilesParsed(t *testing.T) {
+	storage := LocalUploadStorage{Dir: t.TempDir()}
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Post("/upload", func(c *Context) Response {
+		title := c.PostParam("title")
+		files, err := c.SaveFormFiles(storage, UploadOptions{MaxFileSize: 200, AllowedExtensions: []string{".png", ".txt"}})
+		if err != nil {
+			return c.Respond(err)
+		}
+		return c.Respond(200, title+":"+files[0].Filename+","+files[1].Filename)
+	})
+	handler := hs.wrapHandlers(r)
+
+	// the files of the parsed form are saved with the limits
+	w := testServeRequest(handler, newUploadRequest(map[string]string{"title": "docs"}, [2]string{"a.png", string(testPngData)}, [2]string{"b.txt", "hello"}))
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+	assert.EqualValues(t, "docs:a.png,b.txt", w.Body.String())
+	entries, _ := os.ReadDir(storage.Dir)
+	assert.Len(t, entries, 2)
+
+	w = testServeRequest(handler, newUploadRequest(nil, [2]string{"c.png", string(testPngData)}, [2]string{"d.txt", strings.Repeat("a", 201)}))
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.Code)
+	entries, _ = os.ReadDir(storage.Dir)
+	assert.Len(t, entries, 2)
+}
+
+func TestCsrfUpload(t *testing.T) {
+	storage := LocalUploadStorage{Dir: t.TempDir()}
+	hs := testHttpServer(&Options{
+		SessionCookieName:      "test-session",
+		SessionCookieSecureKey: "test-hash-key",
+		SessionStoreType:       SessionStoreMemory,
+	})
+	upload := func(c *Context) Response {
+		files, err := c.SaveFormFiles(storage)
+		if err != nil {
+			return c.Respond(err)
+		}
+		return c.Respond(200, c.PostParam("title")+":"+files[0].Filename)
+	}
+	r := NewRouter()
+	r.Group(func(r Router) {
+		r.Use(Csrf())
+		r.Get("/form", func(c *Context) Response {
+			return c.Respond(200, c.HandlerData[TmplDataKeyCsrfToken].(string))
+		})
+		r.Post("/upload", upload)
+	})
+	r.Group(func(r Router) {
+		r.Use(Csrf(CsrfOptions{AllowQueryToken: true}))
+		r.Post("/upload-query", upload)
+	})
+	handler := hs.wrapHandlers(r)
+	w := testServeRequest(handler, httptest.NewRequest("GET", "/form", nil))
+	cookies, token := w.Result().Cookies(), w.Body.String()
+
+	// the token in the multipart body is parsed by the middleware, and the parsed files are saved
+	req := newUploadRequest(map[string]string{"_csrf": token, "title": "docs"}, [2]string{"a.png", string(testPngData)})
+	w = testServeRequest(handler, req, cookies...)
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+	assert.EqualValues(t, "docs:a.png", w.Body.String())
+
+	req = newUploadRequest(map[string]string{"title": "docs"}, [2]string{"a.png", string(testPngData)})
+	req.Header.Set("X-CSRF-Token", token)
+	w = testServeRequest(handler, req, cookies...)
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+	assert.EqualValues(t, "docs:a.png", w.Body.String())
+
+	// the token in the URL query is only accepted if it's allowed
+	req = newUploadRequest(map[string]string{"title": "docs"}, [2]string{"a.png", string(testPngData)})
+	req.URL.RawQuery = url.Values{"_csrf": {token}}.Encode()
+	assert.EqualValues(t, http.StatusForbidden, testServeRequest(handler, req, cookies...).Code)
+	req = newUploadRequest(map[string]string{"title": "docs"}, [2]string{"a.png", string(testPngData)})
+	req.URL.Path = "/upload-query"
+	req.URL.RawQuery = url.Values{"_csrf": {token}}.Encode()
+	w = testServeRequest(handler, req, cookies...)
+	assert.EqualValues(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -58,10 +58,10 @@ func (c *Context) QueryParamInt64(key string, defs ...int64) int64 {
 PostForm parameters
 */
 
+// PostParam returns the form value, the multipart body is parsed with the server's upload limits,
+// so the upload handlers should call FormFiles or SaveFormFiles before it to apply their own limits
 func (c *Context) PostParam(key string, defs ...string) string {
-	if c.Request.PostForm == nil {
-		_ = c.Request.ParseForm()
-	}
+	_ = c.parseForm()
 	return urlValueStringWithDef(c.Request.PostForm, key, defs...)
 }
 
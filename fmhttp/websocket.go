@@ -0,0 +1,453 @@
+package fmhttp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-farmyard/farmyard/fmlog"
+	"github.com/go-farmyard/farmyard/fmutil"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// the message types (opcodes) of RFC 6455
+const (
+	WebSocketText   = 1
+	WebSocketBinary = 2
+
+	wsOpContinuation = 0
+	wsOpClose        = 8
+	wsOpPing         = 9
+	wsOpPong         = 10
+)
+
+// the close status codes of RFC 6455
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+const wsAcceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type WebSocketOptions struct {
+	// AllowedOrigins are the origins allowed besides the same host, eg: "https://example.com", "*" allows all.
+	// The requests without Origin (non-browser clients) are always allowed.
+	AllowedOrigins []string
+	// CheckOrigin overrides AllowedOrigins if it is set
+	CheckOrigin func(c *Context, origin string) bool
+
+	// Subprotocols are the supported subprotocols in the preferred order
+	Subprotocols []string
+
+	// MaxMessageSize is the maximum size of a received message, default is 1MB
+	MaxMessageSize int64
+
+	// PingInterval is the interval of the keepalive pings, default is 30 seconds, -1 disables it.
+	// The connection is closed if nothing (including pongs) is received in 2 ping intervals.
+	PingInterval time.Duration
+
+	// WriteTimeout is the timeout of writing a message, default is 10 seconds
+	WriteTimeout time.Duration
+}
+
+var websocketDefaultOptions = WebSocketOptions{
+	MaxMessageSize: 1 << 20,
+	PingInterval:   30 * time.Second,
+	WriteTimeout:   10 * time.Second,
+}
+
+// WebSocketCloseError is returned by ReadMessage when the peer closes the connection
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// WebSocketConn is an upgraded connection, the reads must be done by one goroutine, the writes are safe for concurrent use
+type WebSocketConn struct {
+	c           *Context
+	conn        net.Conn
+	reader      *bufio.Reader
+	opt         *WebSocketOptions
+	subprotocol string
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Context returns the request context of the upgrade, eg: the session, the real IP and the path parameters
+func (ws *WebSocketConn) Context() *Context {
+	return ws.c
+}
+
+// Subprotocol returns the negotiated subprotocol, it is empty if there is none
+func (ws *WebSocketConn) Subprotocol() string {
+	return ws.subprotocol
+}
+
+// Done is closed when the connection is closed
+func (ws *WebSocketConn) Done() <-chan struct{} {
+	return ws.closed
+}
+
+func (ws *WebSocketConn) writeFrame(opcode int, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	select {
+	case <-ws.closed:
+		return net.ErrClosed
+	default:
+	}
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(ws.opt.WriteTimeout))
+	return wsWriteFrame(ws.conn, opcode, payload, false)
+}
+
+// wsWriteFrame writes a final frame, the frames from the clients must be masked
+func wsWriteFrame(w io.Writer, opcode int, payload []byte, mask bool) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | byte(opcode)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+	if mask {
+		header[1] |= 0x80
+		maskKey := make([]byte, 4)
+		_, _ = rand.Read(maskKey)
+		header = append(header, maskKey...)
+		masked := make([]byte, length)
+		for i := range payload {
+			masked[i] = payload[i] ^ maskKey[i%4]
+		}
+		payload = masked
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// wsReadFrame reads a frame, the frames from the clients must be masked (requireMask)
+func wsReadFrame(r io.Reader, requireMask bool, maxSize int64) (*wsFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	frame := &wsFrame{fin: header[0]&0x80 != 0, opcode: int(header[0] & 0x0f)}
+	if header[0]&0x70 != 0 {
+		return nil, &WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "reserved bits are set"}
+	}
+	masked := header[1]&0x80 != 0
+	if masked != requireMask {
+		return nil, &WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "invalid mask"}
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(buf))
+	case 127:
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(buf))
+	}
+	if frame.opcode >= wsOpClose && (length > 125 || !frame.fin) {
+		return nil, &WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "invalid control frame"}
+	}
+	if length < 0 || (frame.opcode < wsOpClose && length > maxSize) {
+		return nil, &WebSocketCloseError{Code: WebSocketCloseMessageTooBig, Reason: "message too big"}
+	}
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= maskKey[i%4]
+		}
+	}
+	return frame, nil
+}
+
+func (ws *WebSocketConn) extendReadDeadline() {
+	if ws.opt.PingInterval > 0 {
+		_ = ws.conn.SetReadDeadline(time.Now().Add(2 * ws.opt.PingInterval))
+	}
+}
+
+// ReadMessage returns the next text or binary message, the control frames are handled internally.
+// It returns *WebSocketCloseError if the peer closes the connection.
+func (ws *WebSocketConn) ReadMessage() (msgType int, data []byte, err error) {
+	for {
+		ws.extendReadDeadline()
+		frame, err := wsReadFrame(ws.reader, true, ws.opt.MaxMessageSize-int64(len(data)))
+		if err != nil {
+			return 0, nil, ws.failRead(err)
+		}
+		switch frame.opcode {
+		case wsOpPing:
+			if err = ws.writeFrame(wsOpPong, frame.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+			if len(frame.payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(frame.payload))
+				closeErr.Reason = string(frame.payload[2:])
+			}
+			_ = ws.Close(fmutil.Iif(closeErr.Code == WebSocketCloseNoStatus, WebSocketCloseNormal, closeErr.Code), "")
+			return 0, nil, closeErr
+		case wsOpContinuation:
+			if msgType == 0 {
+				return 0, nil, ws.failRead(&WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "unexpected continuation"})
+			}
+		case WebSocketText, WebSocketBinary:
+			if msgType != 0 {
+				return 0, nil, ws.failRead(&WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "unfinished message"})
+			}
+			msgType = frame.opcode
+		default:
+			return 0, nil, ws.failRead(&WebSocketCloseError{Code: WebSocketCloseProtocolError, Reason: "unknown opcode"})
+		}
+		data = append(data, frame.payload...)
+		if frame.fin {
+			if msgType == WebSocketText && !utf8.Valid(data) {
+				return 0, nil, ws.failRead(&WebSocketCloseError{Code: WebSocketCloseInvalidPayload, Reason: "invalid utf-8"})
+			}
+			return msgType, data, nil
+		}
+	}
+}
+
+// failRead closes the connection with the status of the protocol error
+func (ws *WebSocketConn) failRead(err error) error {
+	var closeErr *WebSocketCloseError
+	if errors.As(err, &closeErr) {
+		_ = ws.Close(closeErr.Code, closeErr.Reason)
+	} else {
+		ws.closeConn()
+	}
+	return err
+}
+
+func (ws *WebSocketConn) WriteMessage(msgType int, data []byte) error {
+	fmutil.MustTrue(msgType == WebSocketText || msgType == WebSocketBinary, "invalid websocket message type: %d", msgType)
+	return ws.writeFrame(msgType, data)
+}
+
+// ReadJson reads a message and decodes it as JSON
+func (ws *WebSocketConn) ReadJson(v any) error {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteJson encodes the value as JSON and writes it as a text message
+func (ws *WebSocketConn) WriteJson(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(WebSocketText, data)
+}
+
+// Close sends a close frame and closes the connection
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason[:min(len(reason), 123)]...)
+	err := ws.writeFrame(wsOpClose, payload)
+	ws.closeConn()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (ws *WebSocketConn) closeConn() {
+	ws.closeOnce.Do(func() {
+		ws.writeMu.Lock()
+		close(ws.closed)
+		ws.writeMu.Unlock()
+		_ = ws.conn.Close()
+	})
+}
+
+func (ws *WebSocketConn) keepalive() {
+	if ws.opt.PingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(ws.opt.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ws.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		case <-ws.closed:
+			return
+		}
+	}
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (opt *WebSocketOptions) checkOrigin(c *Context) bool {
+	origin := c.Request.Header.Get("Origin")
+	if opt.CheckOrigin != nil {
+		return opt.CheckOrigin(c, origin)
+	}
+	if origin == "" {
+		return true
+	}
+	if slices.Contains(opt.AllowedOrigins, "*") || slices.Contains(opt.AllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, c.Request.Host)
+}
+
+// WebSocketHandler returns an endpoint which upgrades the request to a WebSocket connection, then fn handles the connection.
+// The connection is closed normally when fn returns nil, otherwise it is closed with an internal error status.
+// The session is saved before the upgrade, the changes in fn are not saved.
+func WebSocketHandler(fn func(ws *WebSocketConn) error, opts ...WebSocketOptions) RequestHandlerFunc {
+	opt := fmutil.Def(opts, websocketDefaultOptions)
+	opt.MaxMessageSize = fmutil.IfZero(opt.MaxMessageSize, websocketDefaultOptions.MaxMessageSize)
+	opt.PingInterval = fmutil.IfZero(opt.PingInterval, websocketDefaultOptions.PingInterval)
+	opt.WriteTimeout = fmutil.IfZero(opt.WriteTimeout, websocketDefaultOptions.WriteTimeout)
+
+	return func(c *Context) Response {
+		r := c.Request
+		if r.Method != http.MethodGet || !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+			return c.Respond(NewHttpError(http.StatusBadRequest, "not a websocket handshake"))
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			resp := c.Respond(NewHttpError(http.StatusUpgradeRequired, "unsupported websocket version"))
+			resp.Header().Set("Sec-WebSocket-Version", "13")
+			return resp
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+			return c.Respond(NewHttpError(http.StatusBadRequest, "invalid websocket key"))
+		}
+		if !opt.checkOrigin(c) {
+			return c.Respond(NewHttpError(http.StatusForbidden, "websocket origin not allowed"))
+		}
+
+		subprotocol := ""
+		for _, p := range opt.Subprotocols {
+			if headerContainsToken(r.Header, "Sec-WebSocket-Protocol", p) {
+				subprotocol = p
+				break
+			}
+		}
+		return c.Respond(responderWebSocket{req: c, fn: fn, opt: &opt, key: key, subprotocol: subprotocol})
+	}
+}
+
+type responderWebSocket struct {
+	req         *Context
+	fn          func(ws *WebSocketConn) error
+	opt         *WebSocketOptions
+	key         string
+	subprotocol string
+}
+
+func (r responderWebSocket) respondWithStatus(w http.ResponseWriter, _ int) (int64, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return 0, errors.New("websocket: the response writer doesn't support hijacking")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return 0, err
+	}
+
+	acceptHash := sha1.Sum([]byte(r.key + wsAcceptGuid))
+	handshake := strings.Builder{}
+	handshake.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	handshake.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(acceptHash[:]) + "\r\n")
+	if r.subprotocol != "" {
+		handshake.WriteString("Sec-WebSocket-Protocol: " + r.subprotocol + "\r\n")
+	}
+	for _, cookie := range w.Header().Values("Set-Cookie") {
+		handshake.WriteString("Set-Cookie: " + cookie + "\r\n")
+	}
+	handshake.WriteString("\r\n")
+	_ = conn.SetDeadline(time.Time{})
+	if _, err = conn.Write([]byte(handshake.String())); err != nil {
+		_ = conn.Close()
+		return 0, err
+	}
+
+	ws := &WebSocketConn{c: r.req, conn: conn, reader: brw.Reader, opt: r.opt, subprotocol: r.subprotocol, closed: make(chan struct{})}
+	go ws.keepalive()
+	err = r.fn(ws)
+	var closeErr *WebSocketCloseError
+	if err == nil || errors.As(err, &closeErr) || errors.Is(err, net.ErrClosed) {
+		_ = ws.Close(WebSocketCloseNormal, "")
+		return 0, nil
+	}
+	fmlog.Errorf("fmhttp: websocket handler error for %s, err: %v", r.req.Request.RequestURI, err)
+	_ = ws.Close(WebSocketCloseInternalError, "internal error")
+	return 0, nil
+}
@@ -0,0 +1,137 @@
+package fmhttp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	hs := testHttpServer(&Options{})
+	r := NewRouter()
+	r.Use(Compress())
+	r.Get("/ws/{room}", WebSocketHandler(func(ws *WebSocketConn) error {
+		if err := ws.WriteJson(map[string]string{"room": ws.Context().PathParam("room"), "protocol": ws.Subprotocol()}); err != nil {
+			return err
+		}
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if string(data) == "fail" {
+				return errors.New("handler failed")
+			}
+			if err = ws.WriteMessage(msgType, append([]byte("echo:"), data...)); err != nil {
+				return err
+			}
+		}
+	}, WebSocketOptions{Subprotocols: []string{"chat"}, MaxMessageSize: 16, PingInterval: 20 * time.Millisecond}))
+	srv := httptest.NewServer(hs.wrapHandlers(r))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dial := func(path string, headers ...string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", host)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		req := "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"
+		for i := 0; i < len(headers); i += 2 {
+			req += headers[i] + ": " + headers[i+1] + "\r\n"
+		}
+		_, _ = conn.Write([]byte(req + "\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return conn, br, resp
+	}
+	handshake := []string{"Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="}
+	readFrame := func(br *bufio.Reader) *wsFrame {
+		frame, err := wsReadFrame(br, false, 1<<20)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return frame
+	}
+	// readData skips the keepalive pings
+	readData := func(br *bufio.Reader) *wsFrame {
+		for {
+			if frame := readFrame(br); frame.opcode != wsOpPing {
+				return frame
+			}
+		}
+	}
+	writeFragment := func(conn net.Conn, opcode int, payload string) {
+		// a masked non-final frame with a zero mask key
+		frame := append([]byte{byte(opcode), 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+		_, _ = conn.Write(frame)
+	}
+
+	conn, br, resp := dial("/ws/lobby", append(handshake, "Sec-WebSocket-Protocol", "other, chat", "Origin", srv.URL)...)
+	assert.EqualValues(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.EqualValues(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.EqualValues(t, "chat", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	frame := readData(br)
+	assert.EqualValues(t, WebSocketText, frame.opcode)
+	assert.JSONEq(t, `{"room":"lobby","protocol":"chat"}`, string(frame.payload))
+
+	// a fragmented message with an interleaved ping
+	writeFragment(conn, WebSocketText, "hel")
+	assert.NoError(t, wsWriteFrame(conn, wsOpPing, []byte("p1"), true))
+	frame = readData(br)
+	assert.EqualValues(t, wsOpPong, frame.opcode)
+	assert.EqualValues(t, "p1", string(frame.payload))
+	assert.NoError(t, wsWriteFrame(conn, wsOpContinuation, []byte("lo"), true))
+	frame = readData(br)
+	assert.EqualValues(t, "echo:hello", string(frame.payload))
+
+	assert.NoError(t, wsWriteFrame(conn, WebSocketBinary, []byte{1, 2}, true))
+	frame = readData(br)
+	assert.EqualValues(t, WebSocketBinary, frame.opcode)
+	assert.EqualValues(t, []byte("echo:\x01\x02"), frame.payload)
+
+	// the keepalive pings are sent by the server
+	frame = readFrame(br)
+	assert.EqualValues(t, wsOpPing, frame.opcode)
+
+	// the closing handshake
+	assert.NoError(t, wsWriteFrame(conn, wsOpClose, binary.BigEndian.AppendUint16(nil, WebSocketCloseGoingAway), true))
+	frame = readData(br)
+	assert.EqualValues(t, wsOpClose, frame.opcode)
+	assert.EqualValues(t, WebSocketCloseGoingAway, binary.BigEndian.Uint16(frame.payload))
+	_ = conn.Close()
+
+	closeCode := func(msgType int, payload string) int {
+		conn, br, _ := dial("/ws/lobby", handshake...)
+		defer conn.Close()
+		readData(br)
+		assert.NoError(t, wsWriteFrame(conn, msgType, []byte(payload), true))
+		frame := readData(br)
+		assert.EqualValues(t, wsOpClose, frame.opcode)
+		return int(binary.BigEndian.Uint16(frame.payload))
+	}
+	assert.EqualValues(t, WebSocketCloseMessageTooBig, closeCode(WebSocketText, strings.Repeat("a", 17)))
+	assert.EqualValues(t, WebSocketCloseInvalidPayload, closeCode(WebSocketText, "\xff"))
+	assert.EqualValues(t, WebSocketCloseProtocolError, closeCode(wsOpContinuation, "a"))
+	assert.EqualValues(t, WebSocketCloseInternalError, closeCode(WebSocketText, "fail"))
+
+	// the failed handshakes are normal HTTP responses
+	_, _, resp = dial("/ws/lobby", append(handshake, "Origin", "https://evil.example.com")...)
+	assert.EqualValues(t, http.StatusForbidden, resp.StatusCode)
+	_, _, resp = dial("/ws/lobby", "Sec-WebSocket-Version", "8", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	assert.EqualValues(t, http.StatusUpgradeRequired, resp.StatusCode)
+	assert.EqualValues(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+	_, _, resp = dial("/ws/lobby", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "short")
+	assert.EqualValues(t, http.StatusBadRequest, resp.StatusCode)
+}
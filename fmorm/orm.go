@@ -56,6 +56,15 @@ func NewOrm(DB *sqlx.DB) *Orm {
 	return orm
 }
 
+// NewOrmWithExecutor creates an Orm whose commands are executed by the executor, eg: a transaction or a mocked executor
+func NewOrmWithExecutor(dialect Dialect, executor DbExecutor) *Orm {
+	return &Orm{
+		dialect:     dialect,
+		dbExecutor:  executor,
+		fieldMapper: reflectx.NewMapper("db"),
+	}
+}
+
 func (d *Orm) Cmd() *CmdBuilder {
 	return NewCmdBuilder(d)
 }